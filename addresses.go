@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// AddressList is a list of email addresses in the config, written as an array
+// of addresses or as a single address. Addresses may include a display name
+// ("Jane Doe" <jane@example.com>). Version 1 configs could also use
+// comma-separated strings, which are split when they are migrated.
+type AddressList []string
+
+func (l *AddressList) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		*l = AddressList{v}
+	case []any:
+		list := make(AddressList, 0, len(v))
+		for _, entry := range v {
+			s, ok := entry.(string)
+			if !ok {
+				return fmt.Errorf("expected an address, got %v", entry)
+			}
+			list = append(list, s)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected an address or array of addresses, got %v", v)
+	}
+	return nil
+}
+
+// Parse parses the addresses in the list.
+func (l AddressList) Parse() ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, entry := range l {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddress(entry)
+		if err != nil {
+			if list, listErr := mail.ParseAddressList(entry); listErr == nil && len(list) > 1 {
+				return nil, fmt.Errorf("%q has more than one address (use a list)", entry)
+			}
+			return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+		}
+		addrs = append(addrs, parsed)
+	}
+	return addrs, nil
+}
+
+// addresses returns the parsed list, which has already been validated
+func (l AddressList) addresses() []*mail.Address {
+	addrs, _ := l.Parse()
+	return addrs
+}
+
+// RecipientGroup is a set of recipients that get the same emails.
+type RecipientGroup struct {
+	Name string      `toml:"name"`
+	To   AddressList `toml:"to"`
+	Cc   AddressList `toml:"cc"`
+	Bcc  AddressList `toml:"bcc"`
+	// Format overrides email.format for the group
+	Format string `toml:"format"`
+}
+
+// validate checks that the group's addresses parse
+func (g RecipientGroup) validate() error {
+	for _, field := range []struct {
+		name string
+		list AddressList
+	}{{"to", g.To}, {"cc", g.Cc}, {"bcc", g.Bcc}} {
+		if _, err := field.list.Parse(); err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+	}
+	return nil
+}
+
+// Empty reports if the group has no recipients
+func (g RecipientGroup) Empty() bool {
+	return len(g.To.addresses())+len(g.Cc.addresses())+len(g.Bcc.addresses()) == 0
+}
+
+// Envelope returns the bare addresses of all of the group's recipients
+func (g RecipientGroup) Envelope() []string {
+	var rcpt []string
+	for _, list := range []AddressList{g.To, g.Cc, g.Bcc} {
+		for _, addr := range list.addresses() {
+			rcpt = append(rcpt, addr.Address)
+		}
+	}
+	return rcpt
+}
+
+// formatAddresses formats addresses for a To or Cc header
+func formatAddresses(addrs []*mail.Address) string {
+	var formatted []string
+	for _, addr := range addrs {
+		formatted = append(formatted, addr.String())
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// headerAddresses returns the bare addresses in a To or Cc header value
+func headerAddresses(header string) []string {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	addrs, err := mail.ParseAddressList(header)
+	if err != nil {
+		return splitRecipients(header)
+	}
+	var bare []string
+	for _, addr := range addrs {
+		bare = append(bare, addr.Address)
+	}
+	return bare
+}
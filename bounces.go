@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how old a Mailgun webhook's timestamp can be; older (or replayed) webhooks
+// are rejected
+const MAILGUN_WEBHOOK_MAX_AGE = 5 * time.Minute
+
+// mailEvent is a hard bounce or complaint reported for an email we sent
+type mailEvent struct {
+	// "bounce" or "complaint"
+	Type      string `json:"type"`
+	Recipient string `json:"recipient"`
+	// the repo the email was for, if known
+	Repo string `json:"repo,omitempty"`
+	// Message-ID of the email, used to find the repo if not given
+	MessageId string `json:"message_id,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// eventRepos finds the repos affected by ev: the repo it names, the repo that
+// sent the message it refers to, or otherwise every repo that has recently
+// emailed the recipient.
+func (srv Server) eventRepos(ev mailEvent, addr string) ([]string, error) {
+	if ev.Repo != "" {
+		return []string{ev.Repo}, nil
+	}
+	if ev.MessageId != "" {
+		repo, found, err := srv.db.OutboxRepoForMessage(strings.Trim(ev.MessageId, "<>"))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return []string{repo}, nil
+		}
+	}
+	return srv.db.OutboxReposForRecipient(addr)
+}
+
+// handleMailEvent records a bounce or complaint and stops emails to the
+// recipient from the affected repos.
+func (srv Server) handleMailEvent(ev mailEvent) error {
+	if ev.Type != "bounce" && ev.Type != "complaint" {
+		return fmt.Errorf("unknown event type %q", ev.Type)
+	}
+	addr := normalizeAddress(ev.Recipient)
+	if addr == "" {
+		return errors.New("event has no recipient")
+	}
+	repos, err := srv.eventRepos(ev, addr)
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		slog.Info("mail event for unknown repo",
+			slog.String("type", ev.Type),
+			slog.String("to", addr))
+	}
+	for _, repo := range repos {
+		if err := srv.db.AddMailEvent(repo, addr, ev.Type, ev.Detail); err != nil {
+			return err
+		}
+		added, err := srv.db.AddSuppression(repo, addr, ev.Type)
+		if err != nil {
+			return err
+		}
+		if _, err := srv.db.CancelOutbox(repo, addr); err != nil {
+			return err
+		}
+		if !added {
+			continue
+		}
+		slog.Info("suppressed recipient",
+			slog.String("repo", repo),
+			slog.String("to", addr),
+			slog.String("reason", ev.Type))
+		if err := srv.notifySuppression(repo, addr, ev); err != nil {
+			slog.Warn("could not notify recipients of suppression",
+				slog.String("repo", repo),
+				slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+// notifySuppression tells the repo's other recipients that emails to addr
+// were stopped, so someone can fix the config.
+func (srv Server) notifySuppression(repo string, addr string, ev mailEvent) error {
+	owner, _, _ := strings.Cut(repo, "/")
+	org := loadOrgDefaults(srv.cfg.PersistPath, owner)
+	config, err := getConfig(repoGitDir(srv.cfg.PersistPath, repo), "HEAD", org)
+	if err != nil {
+		return err
+	}
+	var others []string
+	seen := map[string]bool{addr: true}
+	for _, other := range config.AllRecipients() {
+		if !seen[normalizeAddress(other)] {
+			seen[normalizeAddress(other)] = true
+			others = append(others, other)
+		}
+	}
+	others = srv.unsuppressedRecipients(repo, others)
+	if len(others) == 0 {
+		return nil
+	}
+	reason := "bounced"
+	if ev.Type == "complaint" {
+		reason = "were marked as spam"
+	}
+	body := fmt.Sprintf(`<p>Commit emails from %s to %s %s, so the bot will no longer send them to this address.</p>
+<p>Please update <code>.github/commit-emails.toml</code> in %s to remove or fix the address.</p>`,
+		html.EscapeString(repo), html.EscapeString(addr), reason, html.EscapeString(repo))
+	if ev.Detail != "" {
+		body += fmt.Sprintf("\n<pre>%s</pre>", html.EscapeString(ev.Detail))
+	}
+	// the notice counts against the installation's rate limit like the
+	// emails that bounced
+	installation, err := srv.db.OutboxInstallation(repo)
+	if err != nil {
+		return err
+	}
+	return srv.queueEmail(installation, repo, EmailMsg{
+		To:       strings.Join(others, ","),
+		From:     fmt.Sprintf("commit-email-bot <%s>", srv.cfg.NotifyEmail()),
+		FromAddr: srv.cfg.EnvelopeSender(),
+		ReplyTo:  srv.cfg.NotifyEmail(),
+		Subject:  fmt.Sprintf("%s: stopped commit emails to %s", repo, addr),
+		Date:     time.Now().Format(time.RFC1123Z),
+		Body:     body,
+	})
+}
+
+// mailgunEvent is the part of a Mailgun webhook payload that we use
+type mailgunEvent struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string `json:"event"`
+		Severity  string `json:"severity"`
+		Recipient string `json:"recipient"`
+		Reason    string `json:"reason"`
+		Message   struct {
+			Headers struct {
+				MessageId string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+		DeliveryStatus struct {
+			Code        int    `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// verify checks the webhook signature, an HMAC of the timestamp and token
+// with the webhook signing key, and that the timestamp is recent
+func (ev mailgunEvent) verify(key string, now time.Time) bool {
+	ts, err := strconv.ParseInt(ev.Signature.Timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > MAILGUN_WEBHOOK_MAX_AGE || age < -MAILGUN_WEBHOOK_MAX_AGE {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(ev.Signature.Timestamp + ev.Signature.Token))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(ev.Signature.Signature))
+}
+
+// webhookTokens records the tokens of recent Mailgun webhooks, so that a
+// webhook can't be replayed while its timestamp is still accepted
+type webhookTokens struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newWebhookTokens() *webhookTokens {
+	return &webhookTokens{seen: make(map[string]time.Time)}
+}
+
+// add records token, returning false if it was already seen
+func (t *webhookTokens) add(token string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tok, at := range t.seen {
+		if now.Sub(at) > 2*MAILGUN_WEBHOOK_MAX_AGE {
+			delete(t.seen, tok)
+		}
+	}
+	if _, ok := t.seen[token]; ok {
+		return false
+	}
+	t.seen[token] = now
+	return true
+}
+
+// remove forgets token, so that a webhook that failed can be retried
+func (t *webhookTokens) remove(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.seen, token)
+}
+
+// toMailEvent converts a Mailgun event, returning false for events other than
+// permanent failures and complaints
+func (ev mailgunEvent) toMailEvent() (mailEvent, bool) {
+	data := ev.EventData
+	out := mailEvent{
+		Recipient: data.Recipient,
+		MessageId: data.Message.Headers.MessageId,
+	}
+	switch {
+	case data.Event == "failed" && data.Severity == "permanent":
+		out.Type = "bounce"
+		out.Detail = strings.TrimSpace(fmt.Sprintf("%d %s %s",
+			data.DeliveryStatus.Code, data.DeliveryStatus.Message, data.DeliveryStatus.Description))
+	case data.Event == "complained":
+		out.Type = "complaint"
+	default:
+		return mailEvent{}, false
+	}
+	return out, true
+}
+
+// mailEventsHandler accepts bounce and complaint webhooks, either from Mailgun
+// (POST /mail-events/mailgun, signed with the webhook signing key) or in our
+// own JSON format (POST /mail-events, a mailEvent authorized by a bearer
+// token). Both are disabled unless MailEventsKey is set.
+func (srv Server) mailEventsHandler(w http.ResponseWriter, req *http.Request) {
+	if srv.cfg.MailEventsKey == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	var ev mailEvent
+	var mgToken string
+	if req.URL.Path == "/mail-events/mailgun" {
+		var mgEvent mailgunEvent
+		if err := json.Unmarshal(body, &mgEvent); err != nil {
+			http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if !mgEvent.verify(srv.cfg.MailEventsKey, now) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		mgToken = mgEvent.Signature.Token
+		if !srv.webhookTokens.add(mgToken, now) {
+			http.Error(w, "webhook already received", http.StatusUnauthorized)
+			return
+		}
+		var ok bool
+		ev, ok = mgEvent.toMailEvent()
+		if !ok {
+			// acknowledge events we don't act on, so they aren't retried
+			_, _ = w.Write([]byte("ignored"))
+			return
+		}
+	} else {
+		token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(srv.cfg.MailEventsKey)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := srv.handleMailEvent(ev); err != nil {
+		if mgToken != "" {
+			srv.webhookTokens.remove(mgToken)
+		}
+		slog.Warn("could not handle mail event",
+			slog.String("type", ev.Type),
+			slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+// parseBounceMessage extracts hard bounces and complaints from a delivery
+// status notification (RFC 3464) or abuse report (RFC 5965). Messages that are
+// neither, and DSNs for delays or temporary failures, produce no events.
+func parseBounceMessage(r io.Reader) ([]mailEvent, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return nil, nil
+	}
+	reportType := strings.ToLower(params["report-type"])
+	if reportType != "delivery-status" && reportType != "feedback-report" {
+		return nil, nil
+	}
+	var reports []textproto.MIMEHeader
+	var original textproto.MIMEHeader
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/feedback-report":
+			reports, err = readHeaderBlocks(part)
+			if err != nil {
+				return nil, err
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			tp := textproto.NewReader(bufio.NewReader(part))
+			original, _ = tp.ReadMIMEHeader()
+		}
+	}
+	messageId := ""
+	if original != nil {
+		messageId = original.Get("Message-Id")
+	}
+
+	var events []mailEvent
+	if reportType == "feedback-report" {
+		if len(reports) == 0 {
+			return nil, nil
+		}
+		recipient := reports[0].Get("Original-Rcpt-To")
+		if recipient == "" && original != nil {
+			recipient = original.Get("To")
+		}
+		if recipient == "" {
+			return nil, errors.New("complaint does not identify the recipient")
+		}
+		events = append(events, mailEvent{
+			Type:      "complaint",
+			Recipient: recipient,
+			MessageId: messageId,
+			Detail:    reports[0].Get("Feedback-Type"),
+		})
+		return events, nil
+	}
+	// the first block has per-message fields, the rest are per-recipient
+	for _, fields := range reports {
+		recipient := dsnAddress(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = dsnAddress(fields.Get("Original-Recipient"))
+		}
+		if recipient == "" {
+			continue
+		}
+		if !strings.EqualFold(fields.Get("Action"), "failed") || !strings.HasPrefix(fields.Get("Status"), "5") {
+			continue
+		}
+		events = append(events, mailEvent{
+			Type:      "bounce",
+			Recipient: recipient,
+			MessageId: messageId,
+			Detail:    strings.TrimSpace(fields.Get("Status") + " " + fields.Get("Diagnostic-Code")),
+		})
+	}
+	return events, nil
+}
+
+// readHeaderBlocks reads groups of header fields separated by blank lines, the
+// format of delivery-status and feedback-report parts
+func readHeaderBlocks(r io.Reader) ([]textproto.MIMEHeader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	var blocks []textproto.MIMEHeader
+	for _, block := range strings.Split(string(data), "\n\n") {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		tp := textproto.NewReader(bufio.NewReader(strings.NewReader(block + "\n\n")))
+		fields, err := tp.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		blocks = append(blocks, fields)
+	}
+	return blocks, nil
+}
+
+// dsnAddress parses a recipient field like "rfc822; user@example.com"
+func dsnAddress(field string) string {
+	addrType, addr, ok := strings.Cut(field, ";")
+	if !ok || !strings.EqualFold(strings.TrimSpace(addrType), "rfc822") {
+		return ""
+	}
+	return strings.TrimSpace(addr)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// where GitHub looks for a CODEOWNERS file, in order
+var CODEOWNERS_PATHS = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// CodeownersConfig maps the owners in CODEOWNERS to email addresses.
+type CodeownersConfig struct {
+	// Emails maps a @user or @org/team to its addresses. Owners given as email
+	// addresses in CODEOWNERS do not need to be listed.
+	Emails map[string]AddressList `toml:"emails"`
+}
+
+func (c CodeownersConfig) validate() error {
+	for owner, list := range c.Emails {
+		if !strings.HasPrefix(owner, "@") {
+			return fmt.Errorf("codeowners.emails: %s should be a @user or @org/team", owner)
+		}
+		if _, err := list.Parse(); err != nil {
+			return fmt.Errorf("codeowners.emails.%s: %w", owner, err)
+		}
+	}
+	return nil
+}
+
+// ownerAddresses returns the email addresses for an owner from CODEOWNERS
+func (c CodeownersConfig) ownerAddresses(owner string) []*mail.Address {
+	if !strings.HasPrefix(owner, "@") {
+		if addr, err := mail.ParseAddress(owner); err == nil {
+			return []*mail.Address{addr}
+		}
+		return nil
+	}
+	// GitHub user and team names are case-insensitive
+	for name, list := range c.Emails {
+		if strings.EqualFold(name, owner) {
+			return list.addresses()
+		}
+	}
+	return nil
+}
+
+// codeownersRule is a line of a CODEOWNERS file
+type codeownersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// parseCodeowners parses a CODEOWNERS file. Lines that are not valid patterns
+// are skipped, as GitHub does.
+func parseCodeowners(text string) []codeownersRule {
+	var rules []codeownersRule
+	for _, line := range strings.Split(text, "\n") {
+		fields := codeownersFields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		pattern, err := codeownersPattern(fields[0])
+		if err != nil {
+			continue
+		}
+		rules = append(rules, codeownersRule{pattern: pattern, owners: fields[1:]})
+	}
+	return rules
+}
+
+// codeownersFields splits a line into whitespace-separated fields, stopping at
+// a comment. Backslashes escape spaces and # in patterns.
+func codeownersFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+			continue
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t' || c == '\r':
+		default:
+			field.WriteByte(c)
+			continue
+		}
+		if field.Len() > 0 {
+			fields = append(fields, field.String())
+			field.Reset()
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// codeownersPattern compiles a CODEOWNERS pattern, which follows gitignore
+// rules except that negation (!) and character ranges are not supported, and
+// a trailing /* only matches files directly in the directory.
+func codeownersPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "!") || strings.ContainsAny(pattern, "[]") {
+		return nil, fmt.Errorf("unsupported pattern %s", pattern)
+	}
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	// patterns with a slash other than at the end are relative to the root,
+	// the others match at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored && !strings.HasPrefix(pattern, "**") {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			re.WriteString("[^/]*")
+		case pattern[i] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	switch {
+	case dirOnly:
+		re.WriteString("/.*")
+	case strings.HasSuffix(pattern, "/*"):
+		// docs/* does not match files in subdirectories of docs
+	default:
+		// a pattern can match a directory, which owns everything in it
+		re.WriteString("(/.*)?")
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// codeownersFor returns the owners of path, from the last rule that matches it
+func codeownersFor(rules []codeownersRule, path string) []string {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].pattern.MatchString(path) {
+			return rules[i].owners
+		}
+	}
+	return nil
+}
+
+// readCodeowners reads the CODEOWNERS file as of commitId. Returns nil if the
+// repo has none.
+func readCodeowners(gitDir string, commitId string) []codeownersRule {
+	for _, path := range CODEOWNERS_PATHS {
+		text, err := GitShow(gitDir, commitId, path)
+		if err == nil {
+			return parseCodeowners(string(text))
+		}
+	}
+	return nil
+}
+
+// changedFiles lists the paths a commit changes (compared to its first parent,
+// so a merge lists what it brings in)
+func changedFiles(gitDir string, commitId string) ([]string, error) {
+	out, err := runGitCmd(gitDir, nil, "diff-tree", "--no-commit-id", "--name-only", "-r", "--root",
+		"--diff-merges=first-parent", "-z", commitId)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, path := range strings.Split(string(out), "\x00") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// codeownersGroup returns a recipient group with the code owners of the files
+// changed by commit, if the config enables notify_codeowners. Addresses in
+// exclude (which already get the email) are left out.
+func (c CommitEmailConfig) codeownersGroup(gitDir string, repo string, commitId string, exclude []string) RecipientGroup {
+	group := RecipientGroup{Name: "codeowners", Format: c.Email.Format}
+	if group.Format == "" {
+		group.Format = "html"
+	}
+	if !c.NotifyCodeowners {
+		return group
+	}
+	rules := readCodeowners(gitDir, commitId)
+	if len(rules) == 0 {
+		return group
+	}
+	paths, err := changedFiles(gitDir, commitId)
+	if err != nil {
+		slog.Warn("could not list changed files",
+			slog.String("repo", repo),
+			slog.String("commit", commitId),
+			slog.String("error", err.Error()))
+		return group
+	}
+	seen := make(map[string]bool)
+	for _, addr := range exclude {
+		seen[normalizeAddress(addr)] = true
+	}
+	unmapped := make(map[string]bool)
+	for _, path := range paths {
+		for _, owner := range codeownersFor(rules, path) {
+			addrs := c.Codeowners.ownerAddresses(owner)
+			if len(addrs) == 0 {
+				unmapped[owner] = true
+			}
+			for _, addr := range addrs {
+				if !seen[normalizeAddress(addr.Address)] {
+					seen[normalizeAddress(addr.Address)] = true
+					group.To = append(group.To, addr.String())
+				}
+			}
+		}
+	}
+	for owner := range unmapped {
+		slog.Debug("code owner has no email",
+			slog.String("repo", repo),
+			slog.String("owner", owner))
+	}
+	return group
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodeownersPatterns(t *testing.T) {
+	rules := parseCodeowners(`
+# comments and blank lines are skipped
+
+*                @everyone
+*.go             @gophers
+/build/          @build-root
+docs/            @docs
+apps/*           @apps
+/scripts/**/test @testers
+**/vendor        @vendor
+/api/v1/         @api @api-review
+!negated         @nobody
+`)
+	for _, tt := range []struct {
+		path   string
+		owners []string
+	}{
+		// no other rule matches
+		{"README.md", []string{"@everyone"}},
+		// unanchored patterns match at any depth
+		{"main.go", []string{"@gophers"}},
+		{"cmd/tool/main.go", []string{"@gophers"}},
+		// a leading / anchors to the root
+		{"build/out.txt", []string{"@build-root"}},
+		{"tools/build/out.txt", []string{"@everyone"}},
+		// a trailing / matches a directory at any depth, and everything in it
+		{"docs/index.md", []string{"@docs"}},
+		{"site/docs/guide/intro.md", []string{"@docs"}},
+		{"docs", []string{"@everyone"}},
+		// a trailing /* only matches files directly in the directory
+		{"apps/web", []string{"@apps"}},
+		{"apps/web/index.html", []string{"@everyone"}},
+		// ** matches any number of directories, including none
+		{"scripts/test", []string{"@testers"}},
+		{"scripts/a/b/test", []string{"@testers"}},
+		{"lib/vendor/x.c", []string{"@vendor"}},
+		{"vendor/x.c", []string{"@vendor"}},
+		// the last matching rule wins, even over a more specific one
+		{"api/v1/handler.go", []string{"@api", "@api-review"}},
+		{"lib/vendor/x.go", []string{"@vendor"}},
+		// negation is not supported, so the line is skipped
+		{"negated", []string{"@everyone"}},
+	} {
+		if owners := codeownersFor(rules, tt.path); !reflect.DeepEqual(owners, tt.owners) {
+			t.Errorf("owners of %s = %v, want %v", tt.path, owners, tt.owners)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// runCommand runs an administrative subcommand against the server's persistent
+// state, instead of running the server.
+func runCommand(cfg AppConfig, args []string) error {
+	switch args[0] {
+	case "resend":
+		return resendCommand(cfg, args[1:])
+	case "outbox":
+		return outboxCommand(cfg, args[1:])
+	case "bounces":
+		return bouncesCommand(cfg, args[1:])
+	case "validate":
+		return validateCommand(args[1:])
+	case "schema":
+		return schemaCommand()
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
+// resendCommand queues a webhook delivery to be processed again.
+func resendCommand(cfg AppConfig, args []string) error {
+	fs := flag.NewFlagSet("resend", flag.ExitOnError)
+	force := fs.Bool("force", false, "send emails even to recipients who already received them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commit-email-bot resend [-force] DELIVERY_ID")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a delivery id")
+	}
+	deliveryId := fs.Arg(0)
+	db, err := stats.New(cfg.PersistPath)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	found, err := db.ResendJob(deliveryId, *force)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no finished delivery %s", deliveryId)
+	}
+	fmt.Printf("queued delivery %s\n", deliveryId)
+	return nil
+}
+
+// outboxCommand lists outgoing messages or requeues one for delivery.
+func outboxCommand(cfg AppConfig, args []string) error {
+	fs := flag.NewFlagSet("outbox", flag.ExitOnError)
+	status := fs.String("status", "", "only list messages with this status (pending, held, sent, or dead)")
+	limit := fs.Int("n", 50, "number of messages to list")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commit-email-bot outbox [-status STATUS] [-n N] list")
+		fmt.Fprintln(fs.Output(), "       commit-email-bot outbox requeue ID")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected a subcommand")
+	}
+	db, err := stats.New(cfg.PersistPath)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	switch fs.Arg(0) {
+	case "list":
+		msgs, err := db.ListOutbox(*status, *limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tATTEMPTS\tREPO\tTO\tSUBJECT\tERROR")
+		for _, msg := range msgs {
+			e := newOutboxEntry(msg)
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\n",
+				e.Id, e.Status, e.Attempts, e.Repo, e.To, e.Subject, e.LastError)
+		}
+		return w.Flush()
+	case "requeue":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return fmt.Errorf("expected a message id")
+		}
+		id, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message id %s", fs.Arg(1))
+		}
+		found, err := db.RequeueOutbox(id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no message %d (or it is being sent)", id)
+		}
+		fmt.Printf("requeued message %d\n", id)
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown outbox command %s", fs.Arg(0))
+	}
+}
+
+// bouncesCommand processes bounce and complaint reports delivered to a local
+// mailbox. Each PATH is a Maildir, whose new messages are processed and moved
+// to cur, or a single message file (- for stdin).
+func bouncesCommand(cfg AppConfig, args []string) error {
+	fs := flag.NewFlagSet("bounces", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commit-email-bot bounces PATH...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected a maildir or message file")
+	}
+	db, err := stats.New(cfg.PersistPath)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	signingKey, err := loadSigningKey(cfg.PersistPath)
+	if err != nil {
+		return err
+	}
+	// notifications are queued in the outbox for the server to deliver
+	srv := Server{cfg: cfg, db: db, signingKey: signingKey}
+	for _, path := range fs.Args() {
+		if err := srv.processBouncePath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (srv Server) processBouncePath(path string) error {
+	if path == "-" {
+		return srv.processBounce(os.Stdin, "stdin")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return srv.processBounce(f, path)
+	}
+	entries, err := os.ReadDir(filepath.Join(path, "new"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(path, "new", entry.Name())
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = srv.processBounce(f, name)
+		f.Close()
+		if err != nil {
+			// leave the message to be retried
+			slog.Warn("could not process bounce",
+				slog.String("file", name),
+				slog.String("error", err.Error()))
+			continue
+		}
+		// mark as seen
+		if err := os.Rename(name, filepath.Join(path, "cur", entry.Name()+":2,S")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (srv Server) processBounce(r io.Reader, name string) error {
+	events, err := parseBounceMessage(r)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		fmt.Printf("%s: %s for %s\n", name, ev.Type, ev.Recipient)
+		if err := srv.handleMailEvent(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCommand checks a commit-emails.toml file (and optionally a
+// CODEOWNERS file), printing its errors and warnings.
+func validateCommand(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	codeowners := fs.String("codeowners", "", "also check this CODEOWNERS file")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commit-email-bot validate [-codeowners FILE] [-json] FILE (- for stdin)")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a config file")
+	}
+	configText, err := readFileOrStdin(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var codeownersText []byte
+	if *codeowners != "" {
+		codeownersText, err = os.ReadFile(*codeowners)
+		if err != nil {
+			return err
+		}
+	}
+	report := checkConfig(configText, codeownersText)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range report.Errors {
+			fmt.Printf("error: %s\n", problem)
+		}
+		for _, problem := range report.Warnings {
+			fmt.Printf("warning: %s\n", problem)
+		}
+	}
+	if !report.Valid {
+		return fmt.Errorf("%s is invalid", fs.Arg(0))
+	}
+	return nil
+}
+
+func readFileOrStdin(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// schemaCommand prints the JSON Schema for commit-emails.toml.
+func schemaCommand() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(configSchema())
+}
@@ -1,20 +1,74 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"reflect"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/google/go-github/v75/github"
 )
 
 // handling repo config (commit-emails.toml)
 
 type CommitEmailConfig struct {
-	MailingList string `toml:"to"`
-	Email       struct {
+	// Version is the version of the config format (see CONFIG_VERSION); older
+	// versions are migrated to the current one when they are loaded.
+	Version int `toml:"version"`
+	// Inherit is false to ignore the organization's default config
+	Inherit *bool `toml:"inherit"`
+	// the default recipients, who get emails in email.format
+	MailingList AddressList `toml:"to"`
+	Cc          AddressList `toml:"cc"`
+	Bcc         AddressList `toml:"bcc"`
+	// Groups are additional recipients, each with their own format
+	Groups []RecipientGroup `toml:"groups"`
+	// Digest is "hourly", "daily", or "weekly" to send a periodic summary
+	// instead of (or in addition to, with DigestTo) one email per commit.
+	Digest string `toml:"digest"`
+	// DigestTo overrides the recipients of digest emails.
+	DigestTo AddressList `toml:"digest_to"`
+	// Dedupe controls when a commit that was already emailed is sent again:
+	// "repository" (the default) sends each commit once per repository,
+	// "branch" once per branch, and "none" relies only on GitHub's report of
+	// which commits are new to the repository.
+	Dedupe string `toml:"dedupe"`
+	// ConfigSource is where the config for a push is read from:
+	// "default-branch" (the default) always uses the default branch's config,
+	// while "pushed-ref" uses the config in the pushed commit, if it has one.
+	ConfigSource string `toml:"config_source"`
+	// NotifyCodeowners also emails the owners (in CODEOWNERS) of the files
+	// each commit changes, with addresses from Codeowners.Emails.
+	NotifyCodeowners bool             `toml:"notify_codeowners"`
+	Codeowners       CodeownersConfig `toml:"codeowners"`
+	// QuietHours holds commit emails (and digests) until a daily window ends
+	QuietHours QuietHours `toml:"quiet_hours"`
+	Email      struct {
 		Format string `toml:"format"`
-	}
+		// Subject and Header are templates for the subject of commit emails
+		// and text shown above the diff (see CommitTemplateData)
+		Subject string `toml:"subject"`
+		Header  string `toml:"header"`
+		// AttachPatch attaches each commit as a .patch file
+		AttachPatch bool `toml:"attach_patch"`
+		// Style is "patch" to send commits as git send-email does, instead
+		// of the default formatted diff
+		Style string `toml:"style"`
+	} `toml:"email"`
+
+	// parsed Email.Subject and Email.Header, if set
+	subjectTmpl *template.Template
+	headerTmpl  *template.Template
+	// problems that do not make the config invalid
+	unknownKeys  []string
+	deprecations []string
 }
 
 type MissingConfigError struct{}
@@ -23,30 +77,491 @@ func (e MissingConfigError) Error() string {
 	return "no commit-emails.toml found"
 }
 
+// ConfigError describes an invalid commit-emails.toml.
+type ConfigError struct {
+	// the file with the error (defaults to CONFIG_PATH)
+	File    string
+	Message string
+	// every problem found by validation (Message joins them)
+	Problems []string
+	// position of a syntax error (0 if unknown)
+	Line   int
+	Column int
+	// keys in the file that are not config options
+	UnknownKeys []string
+}
+
+func (e ConfigError) Error() string {
+	file := e.File
+	if file == "" {
+		file = CONFIG_PATH
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", file, e.Line, e.Column, e.Message)
+	}
+	return file + ": " + e.Message
+}
+
+// decodeConfig decodes configText onto config, so keys it sets override the
+// values already in config. Older versions of the format are migrated after
+// decoding. Returns the keys that are not config options and deprecation
+// warnings from the migration.
+func decodeConfig(configText []byte, file string, config *CommitEmailConfig) (unknown []string, deprecations []string, err error) {
+	var probe struct {
+		Version any `toml:"version"`
+	}
+	if _, err := toml.Decode(string(configText), &probe); err != nil {
+		return nil, nil, tomlConfigError(file, err)
+	}
+	version, err := configVersion(probe.Version)
+	if err != nil {
+		return nil, nil, ConfigError{File: file, Message: err.Error()}
+	}
+	// decoding onto config directly would merge tables in arrays (such as
+	// [[groups]]) with the ones already there
+	var decoded CommitEmailConfig
+	meta, err := toml.Decode(string(configText), &decoded)
+	if err != nil {
+		return nil, nil, tomlConfigError(file, err)
+	}
+	for _, key := range meta.Undecoded() {
+		unknown = append(unknown, key.String())
+	}
+	deprecations = migrateConfig(&decoded, meta, version)
+	mergeDefined(reflect.ValueOf(config).Elem(), reflect.ValueOf(decoded), meta, nil)
+	return unknown, deprecations, nil
+}
+
+// mergeDefined copies the keys meta says are defined from src to dst, which
+// are config structs (or tables in them, at key). Tables are merged key by
+// key, while other values (including lists and maps) are replaced whole.
+func mergeDefined(dst reflect.Value, src reflect.Value, meta toml.MetaData, key []string) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fieldKey := append(append([]string{}, key...), name)
+		if !meta.IsDefined(fieldKey...) {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			mergeDefined(dst.Field(i), src.Field(i), meta, fieldKey)
+		} else {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+func tomlConfigError(file string, err error) ConfigError {
+	cfgErr := ConfigError{File: file, Message: err.Error()}
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) {
+		cfgErr.Message = parseErr.Message
+		cfgErr.Line = parseErr.Position.Line
+		cfgErr.Column = parseErr.Position.Col
+	}
+	return cfgErr
+}
+
 func parseConfig(configText []byte) (config CommitEmailConfig, err error) {
-	meta, err := toml.Decode(string(configText), &config)
+	unknown, deprecations, err := decodeConfig(configText, CONFIG_PATH, &config)
 	if err != nil {
-		return CommitEmailConfig{}, fmt.Errorf("decoding commit-emails.toml: %s", err)
+		return CommitEmailConfig{}, err
 	}
-	if len(meta.Undecoded()) > 0 {
-		var keys []string
-		for _, key := range meta.Undecoded() {
-			keys = append(keys, key.String())
+	config.unknownKeys = unknown
+	config.deprecations = deprecations
+	return validateConfig(config, unknown)
+}
+
+// parseConfigWithDefaults parses a repo's config on top of the organization's
+// defaults (either of which may be nil). Keys set by the repo override the
+// defaults, unless it sets inherit = false to ignore them entirely.
+func parseConfigWithDefaults(orgText []byte, repoText []byte) (config CommitEmailConfig, err error) {
+	if repoText != nil {
+		var probe struct {
+			Inherit *bool `toml:"inherit"`
+		}
+		// errors are reported when the whole config is decoded
+		_, _ = toml.Decode(string(repoText), &probe)
+		if probe.Inherit != nil && !*probe.Inherit {
+			orgText = nil
 		}
-		slog.Warn("unknown config fields", slog.String("fields", strings.Join(keys, ", ")))
+	}
+	var unknown, deprecations []string
+	if orgText != nil {
+		orgUnknown, orgDeprecations, err := decodeConfig(orgText, ORG_CONFIG_FILE, &config)
+		if err != nil {
+			return CommitEmailConfig{}, err
+		}
+		for _, key := range orgUnknown {
+			unknown = append(unknown, ORG_CONFIG_FILE+": "+key)
+		}
+		for _, msg := range orgDeprecations {
+			deprecations = append(deprecations, ORG_CONFIG_FILE+": "+msg)
+		}
+	}
+	if repoText != nil {
+		repoUnknown, repoDeprecations, err := decodeConfig(repoText, CONFIG_PATH, &config)
+		if err != nil {
+			return CommitEmailConfig{}, err
+		}
+		unknown = append(unknown, repoUnknown...)
+		deprecations = append(deprecations, repoDeprecations...)
+	}
+	config.unknownKeys = unknown
+	config.deprecations = deprecations
+	return validateConfig(config, unknown)
+}
+
+// logWarnings logs the problems with a valid config of repo: keys that are
+// not config options and deprecated forms, with the file they are in.
+func (c CommitEmailConfig) logWarnings(repo string) {
+	for _, file := range []string{ORG_CONFIG_FILE, CONFIG_PATH} {
+		var fields []string
+		for _, key := range c.unknownKeys {
+			if keyFile, key := warningFile(key); keyFile == file {
+				fields = append(fields, key)
+			}
+		}
+		if len(fields) > 0 {
+			slog.Warn("unknown config fields",
+				slog.String("repo", repo),
+				slog.String("file", file),
+				slog.String("fields", strings.Join(fields, ", ")))
+		}
+	}
+	for _, msg := range c.deprecations {
+		file, msg := warningFile(msg)
+		slog.Warn("deprecated config",
+			slog.String("repo", repo),
+			slog.String("file", file),
+			slog.String("warning", msg))
+	}
+}
+
+// warningFile splits an unknown key or deprecation warning into the file it
+// is from and the rest (warnings about the org defaults start with their file)
+func warningFile(warning string) (file string, rest string) {
+	if rest, ok := strings.CutPrefix(warning, ORG_CONFIG_FILE+": "); ok {
+		return ORG_CONFIG_FILE, rest
+	}
+	return CONFIG_PATH, warning
+}
+
+// validateConfig checks config values and fills in defaults. All the problems
+// found are reported together.
+func validateConfig(config CommitEmailConfig, unknown []string) (CommitEmailConfig, error) {
+	var problems []string
+	invalid := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
 	}
 	format := config.Email.Format
 	if !(format == "" || format == "html" || format == "text") {
-		return CommitEmailConfig{}, fmt.Errorf("invalid email.format (should be html or text): %s", format)
+		invalid("invalid email.format (should be html or text): %s", format)
+	}
+	if err := config.defaultGroup().validate(); err != nil {
+		invalid("%s", err)
+	}
+	switch config.Email.Style {
+	case "", "default", "patch":
+	default:
+		invalid("invalid email.style (should be default or patch): %s", config.Email.Style)
+	}
+	if config.Email.Subject != "" {
+		tmpl, err := parseEmailTemplate("email.subject", config.Email.Subject)
+		if err != nil {
+			invalid("%s", err)
+		}
+		config.subjectTmpl = tmpl
+	}
+	if config.Email.Header != "" {
+		tmpl, err := parseEmailTemplate("email.header", config.Email.Header)
+		if err != nil {
+			invalid("%s", err)
+		}
+		config.headerTmpl = tmpl
+	}
+	for i, group := range config.Groups {
+		name := group.Name
+		if name == "" {
+			name = fmt.Sprintf("groups[%d]", i)
+		}
+		if err := group.validate(); err != nil {
+			invalid("%s: %s", name, err)
+		} else if group.Empty() {
+			invalid("%s has no recipients", name)
+		}
+		if !(group.Format == "" || group.Format == "html" || group.Format == "text") {
+			invalid("invalid format for %s (should be html or text): %s", name, group.Format)
+		}
+	}
+	if err := config.Codeowners.validate(); err != nil {
+		invalid("%s", err)
+	}
+	if err := config.QuietHours.validate(); err != nil {
+		invalid("quiet_hours: %s", err)
+	}
+	if _, err := config.DigestTo.Parse(); err != nil {
+		invalid("digest_to: %s", err)
+	}
+	digest := config.Digest
+	if !(digest == "" || digest == "hourly" || digest == "daily" || digest == "weekly") {
+		invalid("invalid digest (should be hourly, daily, or weekly): %s", digest)
+	}
+	switch config.Dedupe {
+	case "":
+		config.Dedupe = "repository"
+	case "repository", "branch", "none":
+	default:
+		invalid("invalid dedupe (should be repository, branch, or none): %s", config.Dedupe)
+	}
+	switch config.ConfigSource {
+	case "":
+		config.ConfigSource = "default-branch"
+	case "default-branch", "pushed-ref":
+	default:
+		invalid("invalid config_source (should be default-branch or pushed-ref): %s", config.ConfigSource)
+	}
+	if len(problems) > 0 {
+		return CommitEmailConfig{}, ConfigError{
+			Message:     strings.Join(problems, "; "),
+			Problems:    problems,
+			UnknownKeys: unknown,
+		}
 	}
-	return
+	// the config has been migrated to the current format
+	config.Version = CONFIG_VERSION
+	return config, nil
+}
+
+// includeCommit decides if a commit in a push should be emailed, before
+// checking which recipients have already received it.
+func (c CommitEmailConfig) includeCommit(commit *github.HeadCommit) bool {
+	// with per-branch dedupe, commits already in the repo are still emailed
+	// when they reach a new branch
+	return c.Dedupe == "branch" || commit.GetDistinct()
 }
 
-// getConfig reads the commit-emails.toml file for a git repo
-func getConfig(gitRepo string) (config CommitEmailConfig, err error) {
-	configText, err := GitShow(gitRepo, "HEAD", ".github/commit-emails.toml")
+// dedupeBranch returns the branch to check for previously sent emails, or ""
+// to check across all branches.
+func (c CommitEmailConfig) dedupeBranch(branch string) string {
+	if c.Dedupe == "repository" {
+		return ""
+	}
+	return branch
+}
+
+// defaultGroup is the recipients given at the top level of the config
+func (c CommitEmailConfig) defaultGroup() RecipientGroup {
+	return RecipientGroup{To: c.MailingList, Cc: c.Cc, Bcc: c.Bcc}
+}
+
+// DigestRecipients returns the recipients for digest emails, as a To header
+// and a list of Bcc addresses.
+func (c CommitEmailConfig) DigestRecipients() (to string, bcc []string) {
+	if len(c.DigestTo) > 0 {
+		return formatAddresses(c.DigestTo.addresses()), nil
+	}
+	for _, addr := range c.Bcc.addresses() {
+		bcc = append(bcc, addr.Address)
+	}
+	return formatAddresses(append(c.MailingList.addresses(), c.Cc.addresses()...)), bcc
+}
+
+// CommitGroups returns the groups of recipients for per-commit emails, with
+// their formats filled in. The default recipients are replaced by the digest
+// if it goes to them.
+func (c CommitEmailConfig) CommitGroups() []RecipientGroup {
+	var groups []RecipientGroup
+	if c.Digest == "" || len(c.DigestTo) > 0 {
+		groups = append(groups, c.defaultGroup())
+	}
+	groups = append(groups, c.Groups...)
+	var nonEmpty []RecipientGroup
+	for _, group := range groups {
+		if group.Format == "" {
+			group.Format = c.Email.Format
+		}
+		if group.Format == "" {
+			group.Format = "html"
+		}
+		if !group.Empty() {
+			nonEmpty = append(nonEmpty, group)
+		}
+	}
+	return nonEmpty
+}
+
+// AllRecipients returns the addresses of everyone the config sends email to
+func (c CommitEmailConfig) AllRecipients() []string {
+	rcpt := c.defaultGroup().Envelope()
+	for _, group := range c.Groups {
+		rcpt = append(rcpt, group.Envelope()...)
+	}
+	for _, addr := range c.DigestTo.addresses() {
+		rcpt = append(rcpt, addr.Address)
+	}
+	return rcpt
+}
+
+const CONFIG_PATH = ".github/commit-emails.toml"
+
+// organization defaults are in commit-emails.toml in this repo
+const ORG_CONFIG_REPO = ".github"
+
+// how the org defaults are referred to in errors
+const ORG_CONFIG_FILE = "commit-emails.toml (org defaults)"
+
+// OrgDefaults is the default config for an organization's (or user's) repos,
+// from commit-emails.toml in the root of their .github repo
+type OrgDefaults struct {
+	Text []byte
+	// git object id of the file
+	Hash string
+}
+
+// loadOrgDefaults reads the defaults for owner from its synced .github repo.
+// Returns nil if there are none.
+func loadOrgDefaults(persistPath string, owner string) *OrgDefaults {
+	gitDir := repoGitDir(persistPath, owner+"/"+ORG_CONFIG_REPO)
+	hash, err := GitObjectId(gitDir, "HEAD:commit-emails.toml")
+	if err != nil {
+		return nil
+	}
+	text, err := GitShow(gitDir, "HEAD", "commit-emails.toml")
 	if err != nil {
-		return CommitEmailConfig{}, MissingConfigError{}
+		return nil
+	}
+	return &OrgDefaults{Text: text, Hash: hash}
+}
+
+// getConfig reads the commit-emails.toml file for a git repo at a revision,
+// with org defaults if not nil. A repo without its own config uses the
+// defaults.
+func getConfig(gitRepo string, rev string, org *OrgDefaults) (config CommitEmailConfig, err error) {
+	configText, err := GitShow(gitRepo, rev, CONFIG_PATH)
+	if err != nil {
+		if org == nil {
+			return CommitEmailConfig{}, MissingConfigError{}
+		}
+		configText = nil
+	}
+	if org == nil {
+		return parseConfig(configText)
+	}
+	return parseConfigWithDefaults(org.Text, configText)
+}
+
+// configHash identifies the version of the config at rev, including the org
+// defaults
+func configHash(gitDir string, rev string, org *OrgDefaults) string {
+	hash, _ := GitObjectId(gitDir, rev+":"+CONFIG_PATH)
+	if org != nil {
+		hash += "+" + org.Hash
+	}
+	return hash
+}
+
+// configRev returns the revision whose config applies to a push of the commit
+// pushed (empty if the push deleted a ref). The default branch's config is
+// used unless it sets config_source = "pushed-ref" and the pushed commit has a
+// config. In a repo with no config on the default branch (or in the org
+// defaults), a config in the pushed commit applies if it sets config_source =
+// "pushed-ref" (or cannot be parsed, so that the error is reported).
+func configRev(gitDir string, pushed string, org *OrgDefaults) string {
+	head, err := getConfig(gitDir, "HEAD", org)
+	if pushed == "" {
+		return "HEAD"
+	}
+	if _, missing := err.(MissingConfigError); !missing {
+		if err == nil && head.ConfigSource == "pushed-ref" {
+			if _, err := GitObjectId(gitDir, pushed+":"+CONFIG_PATH); err == nil {
+				return pushed
+			}
+		}
+		return "HEAD"
+	}
+	config, err := getConfig(gitDir, pushed, org)
+	if _, missing := err.(MissingConfigError); missing {
+		return "HEAD"
+	}
+	if err != nil || config.ConfigSource == "pushed-ref" {
+		return pushed
+	}
+	return "HEAD"
+}
+
+// how often the owner's .github repo is checked for changes to the org
+// defaults (pushes to the .github repo itself sync it right away)
+const ORG_DEFAULTS_SYNC_INTERVAL = 10 * time.Minute
+
+// orgSyncs records when each owner's .github repo was last checked, so that
+// it isn't fetched on every push
+type orgSyncs struct {
+	mu      sync.Mutex
+	checked map[string]time.Time
+}
+
+func newOrgSyncs() *orgSyncs {
+	return &orgSyncs{checked: make(map[string]time.Time)}
+}
+
+// due reports whether owner's .github repo should be checked again, and if so
+// records that it is being checked now
+func (s *orgSyncs) due(owner string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.checked[owner]; ok && time.Since(last) < ORG_DEFAULTS_SYNC_INTERVAL {
+		return false
+	}
+	s.checked[owner] = time.Now()
+	return true
+}
+
+// syncOrgDefaults fetches the owner's .github repo (at most every
+// ORG_DEFAULTS_SYNC_INTERVAL) and returns its default config, or nil if it has
+// none (or the app can't access it).
+func (h PushHandler) syncOrgDefaults(ctx context.Context, client *github.Client, ev *github.PushEvent) *OrgDefaults {
+	owner := ev.GetRepo().GetOwner().GetLogin()
+	if ev.GetRepo().GetName() == ORG_CONFIG_REPO {
+		// already synced by the push itself
+		h.srv.orgSyncs.due(owner)
+	} else if h.srv.orgSyncs.due(owner) {
+		h.syncOrgRepo(ctx, client, owner)
+	}
+	return loadOrgDefaults(h.srv.cfg.PersistPath, owner)
+}
+
+func (h PushHandler) syncOrgRepo(ctx context.Context, client *github.Client, owner string) {
+	repo, resp, err := client.Repositories.Get(ctx, owner, ORG_CONFIG_REPO)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			// the owner has no .github repo, or the installation doesn't include it
+			slog.Info("no org config repo",
+				slog.String("owner", owner))
+			return
+		}
+		slog.Warn("could not look up org config repo",
+			slog.String("owner", owner),
+			slog.String("error", err.Error()))
+		return
+	}
+	orgRepo := &github.PushEventRepository{
+		Name:     repo.Name,
+		FullName: repo.FullName,
+		CloneURL: repo.CloneURL,
+	}
+	if _, err := SyncRepo(ctx, client, orgRepo, h.srv.cfg.PersistPath); err != nil {
+		slog.Warn("could not sync org config repo",
+			slog.String("owner", owner),
+			slog.String("error", err.Error()))
 	}
-	return parseConfig(configText)
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v75/github"
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// status context used for commit statuses about the config
+const CONFIG_STATUS_CONTEXT = "commit-emails"
+
+// loadConfig reads the config that applies to a push (see configRev). When the
+// push changes the config, the change is recorded; if the new config is
+// invalid, the repo's last recipients and the pusher are told why, once per
+// version of the file. A valid config with unknown keys (likely typos) is
+// reported to its recipients and the pusher in the same way.
+func (h PushHandler) loadConfig(ctx context.Context, client *github.Client, gitDir string, org *OrgDefaults, ev *github.PushEvent) (CommitEmailConfig, error) {
+	pushed := ev.GetAfter()
+	if ev.GetDeleted() {
+		pushed = ""
+	}
+	rev := configRev(gitDir, pushed, org)
+	config, err := getConfig(gitDir, rev, org)
+	var cfgErr ConfigError
+	if err != nil && !errors.As(err, &cfgErr) {
+		return config, err
+	}
+	if err == nil {
+		config.logWarnings(h.repo)
+	}
+	hash := configHash(gitDir, rev, org)
+	// configs read from a pushed branch are tracked separately from the
+	// default branch's
+	ref := ""
+	if rev != "HEAD" {
+		ref = ev.GetRef()
+	}
+	prev, found, dbErr := h.srv.db.GetRepoConfig(h.repo, ref)
+	if dbErr != nil {
+		slog.Warn("could not get previous config",
+			slog.String("repo", h.repo),
+			slog.String("error", dbErr.Error()))
+	}
+	if found && prev.Hash == hash {
+		return config, err
+	}
+	if !found && ref != "" {
+		// a branch's first config inherits the default branch's recipients
+		prev, _, _ = h.srv.db.GetRepoConfig(h.repo, "")
+	}
+
+	current := stats.RepoConfig{Repo: h.repo, Ref: ref, Hash: hash, Valid: err == nil}
+	if err == nil {
+		current.Recipients = strings.Join(config.AllRecipients(), ",")
+		if len(config.unknownKeys) > 0 {
+			warning := ConfigError{UnknownKeys: config.unknownKeys}
+			if notifyErr := h.notifyConfig(ev, current.Recipients, "unknown keys in commit-emails.toml", configWarningTemplate, warning); notifyErr != nil {
+				slog.Warn("could not send config warning email",
+					slog.String("repo", h.repo),
+					slog.String("error", notifyErr.Error()))
+			}
+		}
+	} else {
+		current.Recipients = prev.Recipients
+		slog.Info("invalid config",
+			slog.String("repo", h.repo),
+			slog.String("error", err.Error()))
+		if notifyErr := h.notifyConfig(ev, prev.Recipients, "invalid commit-emails.toml", configErrorTemplate, cfgErr); notifyErr != nil {
+			slog.Warn("could not send config error email",
+				slog.String("repo", h.repo),
+				slog.String("error", notifyErr.Error()))
+		}
+	}
+	if h.srv.cfg.ConfigStatus && (err != nil || (found && !prev.Valid) || len(config.unknownKeys) > 0) {
+		h.postConfigStatus(ctx, client, ev, err, config.unknownKeys)
+	}
+	if dbErr := h.srv.db.SetRepoConfig(current); dbErr != nil {
+		slog.Warn("could not record config",
+			slog.String("repo", h.repo),
+			slog.String("error", dbErr.Error()))
+	}
+	return config, err
+}
+
+var configErrorTemplate = template.Must(template.New("config-error").Parse(`<html>
+<body>
+<p>The commit-emails configuration in <b>{{.Repo}}</b> is invalid, so commit
+emails are paused until it is fixed.</p>
+{{if .CommitURL}}<p>The change was pushed in <a href="{{.CommitURL}}">{{.Commit}}</a>.</p>{{end}}
+{{if .Err.Problems}}<p>Problems in {{or .Err.File ".github/commit-emails.toml"}}:</p>
+<ul>
+{{range .Err.Problems}}<li><pre>{{.}}</pre></li>
+{{end}}</ul>
+{{else}}<pre>{{or .Err.File ".github/commit-emails.toml"}}{{if .Err.Line}}, line {{.Err.Line}}, column {{.Err.Column}}{{end}}: {{.Err.Message}}</pre>{{end}}
+{{if .Err.UnknownKeys}}<p>These keys are not config options:</p>
+<ul>
+{{range .Err.UnknownKeys}}<li><code>{{.}}</code></li>
+{{end}}</ul>{{end}}
+</body>
+</html>`))
+
+var configWarningTemplate = template.Must(template.New("config-warning").Parse(`<html>
+<body>
+<p>The commit-emails configuration in <b>{{.Repo}}</b> has keys that are not
+config options, which are ignored. Commit emails are still being sent, but
+please check these keys for typos:</p>
+<ul>
+{{range .Err.UnknownKeys}}<li><code>{{.}}</code></li>
+{{end}}</ul>
+{{if .CommitURL}}<p>The change was pushed in <a href="{{.CommitURL}}">{{.Commit}}</a>.</p>{{end}}
+</body>
+</html>`))
+
+// notifyConfig emails recipients (the repo's last valid recipients) and the
+// pusher about a problem with the config, as described by tmpl
+// (configErrorTemplate or configWarningTemplate).
+func (h PushHandler) notifyConfig(ev *github.PushEvent, recipients string, subject string, tmpl *template.Template, cfgErr ConfigError) error {
+	to := splitRecipients(recipients)
+	if pusher := ev.GetPusher().GetEmail(); pusher != "" && !strings.HasSuffix(pusher, "@users.noreply.github.com") {
+		to = append(to, pusher)
+	}
+	var unique []string
+	seen := make(map[string]bool)
+	for _, addr := range to {
+		if !seen[normalizeAddress(addr)] {
+			seen[normalizeAddress(addr)] = true
+			unique = append(unique, addr)
+		}
+	}
+	to = h.srv.unsuppressedRecipients(h.repo, unique)
+	if len(to) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, struct {
+		Repo      string
+		Commit    string
+		CommitURL string
+		Err       ConfigError
+	}{
+		Repo:      h.repo,
+		Commit:    shortSHA(ev.GetAfter()),
+		CommitURL: ev.GetHeadCommit().GetURL(),
+		Err:       cfgErr,
+	})
+	if err != nil {
+		return err
+	}
+	cfg := h.srv.cfg
+	return h.srv.queueEmail(h.installation, h.repo, EmailMsg{
+		To:       strings.Join(to, ","),
+		From:     fmt.Sprintf("commit-email-bot <%s>", cfg.NotifyEmail()),
+		FromAddr: cfg.EnvelopeSender(),
+		ReplyTo:  cfg.NotifyEmail(),
+		Subject:  fmt.Sprintf("%s: %s", h.repo, subject),
+		Date:     time.Now().Format(time.RFC1123Z),
+		Body:     body.String(),
+	})
+}
+
+// postConfigStatus sets a commit status on the pushed commit reporting if the
+// config is valid, and any unknown keys in a valid config.
+func (h PushHandler) postConfigStatus(ctx context.Context, client *github.Client, ev *github.PushEvent, configErr error, unknown []string) {
+	state, desc := "success", "commit-emails.toml is valid"
+	if configErr != nil {
+		state, desc = "failure", configErr.Error()
+	} else if len(unknown) > 0 {
+		desc = "commit-emails.toml is valid, but has unknown keys: " + strings.Join(unknown, ", ")
+	}
+	// GitHub limits descriptions to 140 characters
+	if len(desc) > 140 {
+		desc = desc[:137] + "..."
+	}
+	status := &github.RepoStatus{
+		State:       github.Ptr(state),
+		Description: github.Ptr(desc),
+		Context:     github.Ptr(CONFIG_STATUS_CONTEXT),
+	}
+	_, _, err := client.Repositories.CreateStatus(ctx,
+		ev.GetRepo().GetOwner().GetLogin(), ev.GetRepo().GetName(), ev.GetAfter(), status)
+	if err != nil {
+		slog.Warn("could not post config status",
+			slog.String("repo", h.repo),
+			slog.String("error", err.Error()))
+	}
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CONFIG_VERSION is the current version of the commit-emails.toml format.
+// Configs without a version key are version 1.
+//
+//   - version 1: recipients are comma-separated strings (to = "a@x, b@y")
+//   - version 2: recipients are lists, with one address per entry
+const CONFIG_VERSION = 2
+
+// configMigration upgrades a decoded config from version From to From+1. It
+// only changes the keys meta says the file defines, since the config may
+// already hold values from the org defaults. It returns a deprecation warning
+// for each old form it rewrote.
+type configMigration struct {
+	From    int
+	Migrate func(config *CommitEmailConfig, meta toml.MetaData) []string
+}
+
+// configMigrations upgrade configs one version at a time, in order
+var configMigrations = []configMigration{
+	{From: 1, Migrate: migrateRecipientLists},
+}
+
+// configVersion checks the value of a config's version key (nil if it is not
+// set) and returns the version.
+func configVersion(v any) (int, error) {
+	if v == nil {
+		return 1, nil
+	}
+	version, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("version should be an integer, not %q", fmt.Sprint(v))
+	}
+	if version < 1 || version > CONFIG_VERSION {
+		return 0, fmt.Errorf("unsupported version %d (the latest is %d)", version, CONFIG_VERSION)
+	}
+	return int(version), nil
+}
+
+// migrateConfig upgrades config, decoded from a file of the given version, to
+// CONFIG_VERSION, returning deprecation warnings for the old forms it used.
+func migrateConfig(config *CommitEmailConfig, meta toml.MetaData, version int) (deprecations []string) {
+	for _, m := range configMigrations {
+		if m.From >= version {
+			deprecations = append(deprecations, m.Migrate(config, meta)...)
+		}
+	}
+	return deprecations
+}
+
+// migrateRecipientLists upgrades version 1 to 2 by splitting comma-separated
+// recipients into lists. In version 2 such strings are invalid.
+func migrateRecipientLists(config *CommitEmailConfig, meta toml.MetaData) []string {
+	var deprecations []string
+	split := func(list *AddressList, name string) {
+		var migrated AddressList
+		for _, entry := range *list {
+			addrs, err := mail.ParseAddressList(entry)
+			// invalid addresses are left for validation to report
+			if err != nil || len(addrs) < 2 {
+				migrated = append(migrated, entry)
+				continue
+			}
+			for _, addr := range addrs {
+				migrated = append(migrated, addr.String())
+			}
+		}
+		if len(migrated) > len(*list) {
+			*list = migrated
+			deprecations = append(deprecations,
+				fmt.Sprintf("%s: comma-separated addresses are deprecated, use a list (and set version = %d)", name, CONFIG_VERSION))
+		}
+	}
+	for _, field := range []struct {
+		key  string
+		list *AddressList
+	}{
+		{"to", &config.MailingList},
+		{"cc", &config.Cc},
+		{"bcc", &config.Bcc},
+		{"digest_to", &config.DigestTo},
+	} {
+		if meta.IsDefined(field.key) {
+			split(field.list, field.key)
+		}
+	}
+	if meta.IsDefined("groups") {
+		for i := range config.Groups {
+			group := &config.Groups[i]
+			split(&group.To, fmt.Sprintf("groups[%d].to", i))
+			split(&group.Cc, fmt.Sprintf("groups[%d].cc", i))
+			split(&group.Bcc, fmt.Sprintf("groups[%d].bcc", i))
+		}
+	}
+	owners := make([]string, 0, len(config.Codeowners.Emails))
+	for owner := range config.Codeowners.Emails {
+		if meta.IsDefined("codeowners", "emails", owner) {
+			owners = append(owners, owner)
+		}
+	}
+	// so warnings are in a consistent order
+	sort.Strings(owners)
+	for _, owner := range owners {
+		list := config.Codeowners.Emails[owner]
+		split(&list, "codeowners.emails."+owner)
+		config.Codeowners.Emails[owner] = list
+	}
+	return deprecations
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigMigrations(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// check compares the parsed config to what is expected
+		check        func(t *testing.T, c CommitEmailConfig)
+		deprecations []string
+		// err is part of the expected error, if the config is invalid
+		err string
+	}{
+		{
+			name: "v1 comma-separated recipients",
+			config: `
+to = "alice@example.com, Bob <bob@example.net>"
+cc = "carol@example.com,dave@example.com"
+bcc = "archive@example.com, backup@example.com"
+digest_to = "manager@example.com, lead@example.com"
+`,
+			check: func(t *testing.T, c CommitEmailConfig) {
+				expectList(t, "to", c.MailingList, "<alice@example.com>", `"Bob" <bob@example.net>`)
+				expectList(t, "cc", c.Cc, "<carol@example.com>", "<dave@example.com>")
+				expectList(t, "bcc", c.Bcc, "<archive@example.com>", "<backup@example.com>")
+				expectList(t, "digest_to", c.DigestTo, "<manager@example.com>", "<lead@example.com>")
+			},
+			deprecations: []string{
+				"to: comma-separated addresses are deprecated, use a list (and set version = 2)",
+				"cc: comma-separated addresses are deprecated, use a list (and set version = 2)",
+				"bcc: comma-separated addresses are deprecated, use a list (and set version = 2)",
+				"digest_to: comma-separated addresses are deprecated, use a list (and set version = 2)",
+			},
+		},
+		{
+			name: "v1 single addresses",
+			config: `
+to = "\"Doe, Jane\" <jane@example.com>"
+cc = "carol@example.com"
+`,
+			check: func(t *testing.T, c CommitEmailConfig) {
+				expectList(t, "to", c.MailingList, `"Doe, Jane" <jane@example.com>`)
+				expectList(t, "cc", c.Cc, "carol@example.com")
+			},
+		},
+		{
+			name: "v1 groups tables",
+			config: `
+[[groups]]
+name = "ci"
+to = "ci@example.com, bot@example.com"
+format = "text"
+
+[[groups]]
+name = "docs"
+to = "docs@example.com"
+bcc = "a@example.com,b@example.com"
+`,
+			check: func(t *testing.T, c CommitEmailConfig) {
+				if len(c.Groups) != 2 {
+					t.Fatalf("expected 2 groups, got %d", len(c.Groups))
+				}
+				expectList(t, "groups[0].to", c.Groups[0].To, "<ci@example.com>", "<bot@example.com>")
+				expectList(t, "groups[1].to", c.Groups[1].To, "docs@example.com")
+				expectList(t, "groups[1].bcc", c.Groups[1].Bcc, "<a@example.com>", "<b@example.com>")
+			},
+			deprecations: []string{
+				"groups[0].to: comma-separated addresses are deprecated, use a list (and set version = 2)",
+				"groups[1].bcc: comma-separated addresses are deprecated, use a list (and set version = 2)",
+			},
+		},
+		{
+			name: "v1 inline groups",
+			config: `
+groups = [{ name = "ci", cc = "ci@example.com, bot@example.com" }]
+`,
+			check: func(t *testing.T, c CommitEmailConfig) {
+				if len(c.Groups) != 1 {
+					t.Fatalf("expected 1 group, got %d", len(c.Groups))
+				}
+				expectList(t, "groups[0].cc", c.Groups[0].Cc, "<ci@example.com>", "<bot@example.com>")
+			},
+			deprecations: []string{
+				"groups[0].cc: comma-separated addresses are deprecated, use a list (and set version = 2)",
+			},
+		},
+		{
+			name: "v1 codeowners emails",
+			config: `
+to = "dev@example.com"
+notify_codeowners = true
+
+[codeowners.emails]
+"@docs" = "docs@example.com, writer@example.com"
+"@alice" = "alice@example.com"
+"@bob" = "bob@example.com,robert@example.com"
+`,
+			check: func(t *testing.T, c CommitEmailConfig) {
+				expectList(t, "@docs", c.Codeowners.Emails["@docs"], "<docs@example.com>", "<writer@example.com>")
+				expectList(t, "@alice", c.Codeowners.Emails["@alice"], "alice@example.com")
+				expectList(t, "@bob", c.Codeowners.Emails["@bob"], "<bob@example.com>", "<robert@example.com>")
+			},
+			deprecations: []string{
+				"codeowners.emails.@bob: comma-separated addresses are deprecated, use a list (and set version = 2)",
+				"codeowners.emails.@docs: comma-separated addresses are deprecated, use a list (and set version = 2)",
+			},
+		},
+		{
+			name: "v2 lists",
+			config: `
+version = 2
+to = ["alice@example.com", "Bob <bob@example.net>"]
+bcc = "archive@example.com"
+
+[[groups]]
+to = ["ci@example.com"]
+
+[codeowners.emails]
+"@docs" = ["docs@example.com", "writer@example.com"]
+`,
+			check: func(t *testing.T, c CommitEmailConfig) {
+				expectList(t, "to", c.MailingList, "alice@example.com", "Bob <bob@example.net>")
+				expectList(t, "bcc", c.Bcc, "archive@example.com")
+				expectList(t, "groups[0].to", c.Groups[0].To, "ci@example.com")
+				expectList(t, "@docs", c.Codeowners.Emails["@docs"], "docs@example.com", "writer@example.com")
+			},
+		},
+		{
+			name:   "v2 comma-separated recipients",
+			config: "version = 2\nto = \"alice@example.com, bob@example.net\"\n",
+			err:    "has more than one address (use a list)",
+		},
+		{
+			name:   "version is a string",
+			config: "version = \"2\"\nto = [\"alice@example.com\"]\n",
+			err:    `version should be an integer, not "2"`,
+		},
+		{
+			name:   "version too new",
+			config: "version = 3\nto = [\"alice@example.com\"]\n",
+			err:    "unsupported version 3 (the latest is 2)",
+		},
+		{
+			name:   "version zero",
+			config: "version = 0\nto = [\"alice@example.com\"]\n",
+			err:    "unsupported version 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig([]byte(tt.config))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if config.Version != CONFIG_VERSION {
+				t.Errorf("version is %d, expected %d", config.Version, CONFIG_VERSION)
+			}
+			if !reflect.DeepEqual(config.deprecations, tt.deprecations) {
+				t.Errorf("deprecations:\n got %q\nwant %q", config.deprecations, tt.deprecations)
+			}
+			tt.check(t, config)
+		})
+	}
+}
+
+// TestConfigMigrationPositions checks that errors in version 1 configs point
+// at the right place in the file.
+func TestConfigMigrationPositions(t *testing.T) {
+	_, err := parseConfig([]byte("to = \"a@example.com, b@example.com\"\ndigest = \"daily\"\nformat = = 1\n"))
+	cfgErr, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+	if cfgErr.Line != 3 {
+		t.Errorf("error is on line %d, expected 3: %v", cfgErr.Line, err)
+	}
+}
+
+// TestConfigMigrationOrgDefaults checks that a version 1 repo config does not
+// warn about the org defaults' lists.
+func TestConfigMigrationOrgDefaults(t *testing.T) {
+	org := "version = 2\nbcc = [\"archive@example.com\"]\n"
+	repo := "to = \"a@example.com, b@example.com\"\n"
+	config, err := parseConfigWithDefaults([]byte(org), []byte(repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectList(t, "to", config.MailingList, "<a@example.com>", "<b@example.com>")
+	expectList(t, "bcc", config.Bcc, "archive@example.com")
+	want := []string{"to: comma-separated addresses are deprecated, use a list (and set version = 2)"}
+	if !reflect.DeepEqual(config.deprecations, want) {
+		t.Errorf("deprecations:\n got %q\nwant %q", config.deprecations, want)
+	}
+}
+
+func expectList(t *testing.T, name string, list AddressList, want ...string) {
+	t.Helper()
+	if !reflect.DeepEqual([]string(list), want) {
+		t.Errorf("%s:\n got %q\nwant %q", name, []string(list), want)
+	}
+}
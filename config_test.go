@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestConfigProblems checks that an invalid config reports all of its
+// problems, not just the first.
+func TestConfigProblems(t *testing.T) {
+	_, err := parseConfig([]byte(`
+version = 2
+to = ["dev@example.com"]
+digest = "monthly"
+dedupe = "commit"
+
+[email]
+format = "markdown"
+
+[[groups]]
+name = "empty"
+`))
+	cfgErr, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+	want := []string{
+		"invalid email.format (should be html or text): markdown",
+		"empty has no recipients",
+		"invalid digest (should be hourly, daily, or weekly): monthly",
+		"invalid dedupe (should be repository, branch, or none): commit",
+	}
+	if !reflect.DeepEqual(cfgErr.Problems, want) {
+		t.Errorf("problems:\n got %q\nwant %q", cfgErr.Problems, want)
+	}
+
+	report := checkConfig([]byte("version = 2\ndigest = \"monthly\"\ndedupe = \"commit\"\n"), nil)
+	if report.Valid || len(report.Errors) != 2 {
+		t.Errorf("expected 2 errors from checkConfig, got %+v", report.Errors)
+	}
+}
+
+func TestWarningFile(t *testing.T) {
+	for _, tt := range []struct {
+		warning    string
+		file, rest string
+	}{
+		{"email.colour", CONFIG_PATH, "email.colour"},
+		{ORG_CONFIG_FILE + ": email.colour", ORG_CONFIG_FILE, "email.colour"},
+	} {
+		file, rest := warningFile(tt.warning)
+		if file != tt.file || rest != tt.rest {
+			t.Errorf("warningFile(%q) = %q, %q; want %q, %q", tt.warning, file, rest, tt.file, tt.rest)
+		}
+	}
+}
+
+// TestConfigOrgDefaults checks how a repo config is merged with the org
+// defaults: keys the repo sets replace the defaults' values (lists whole),
+// tables are merged key by key, and inherit = false ignores the defaults.
+func TestConfigOrgDefaults(t *testing.T) {
+	org := `
+version = 2
+to = ["all@example.com"]
+bcc = ["archive@example.com"]
+digest = "daily"
+
+[email]
+format = "text"
+subject = "{{.Repo}}: {{.Subject}}"
+
+[[groups]]
+name = "org-ci"
+to = ["ci@example.com"]
+cc = ["ci-cc@example.com"]
+bcc = ["ci-bcc@example.com"]
+format = "html"
+
+[[groups]]
+name = "org-docs"
+to = ["docs@example.com"]
+`
+	repo := `
+version = 2
+to = ["dev@example.com"]
+
+[email]
+attach_patch = true
+
+[[groups]]
+to = ["reviewers@example.com"]
+`
+	config, err := parseConfigWithDefaults([]byte(org), []byte(repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectList(t, "to", config.MailingList, "dev@example.com")
+	expectList(t, "bcc", config.Bcc, "archive@example.com")
+	if config.Digest != "daily" {
+		t.Errorf("digest is %q, expected the default daily", config.Digest)
+	}
+	if config.Email.Format != "text" || config.Email.Subject == "" || !config.Email.AttachPatch {
+		t.Errorf("email table not merged: %+v", config.Email)
+	}
+	want := []RecipientGroup{{To: AddressList{"reviewers@example.com"}}}
+	if !reflect.DeepEqual(config.Groups, want) {
+		t.Errorf("groups:\n got %+v\nwant %+v", config.Groups, want)
+	}
+
+	config, err = parseConfigWithDefaults([]byte(org), []byte("version = 2\ncc = [\"cc@example.com\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Groups) != 2 || config.Groups[0].Name != "org-ci" {
+		t.Errorf("expected the org's groups, got %+v", config.Groups)
+	}
+
+	config, err = parseConfigWithDefaults([]byte(org), []byte("version = 2\ninherit = false\nto = [\"dev@example.com\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Bcc) != 0 || len(config.Groups) != 0 || config.Digest != "" {
+		t.Errorf("inherit = false kept org defaults: %+v", config)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html"
+	"log/slog"
 	"os/exec"
 	"strings"
 	"time"
@@ -41,8 +43,24 @@ func coloredDiffToHtml(output string, commitURL string) (string, error) {
 	return emailHtml, nil
 }
 
-func gitDiffHtml(gitDir string, commitId string, commitURL string) (string, error) {
-	gitCmd := exec.Command("git", "show", "--color=always", "--compact-summary", "--patch", "--pretty=format:%h|%B", commitId)
+// excludePathspecs are pathspecs for git show that leave out paths (such as
+// binary files) from the diff
+func excludePathspecs(paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	pathspecs := []string{"--"}
+	for _, path := range paths {
+		pathspecs = append(pathspecs, ":(exclude,literal)"+path)
+	}
+	return pathspecs
+}
+
+// gitDiffHtml formats a commit as html, leaving the paths in exclude out of
+// the diff
+func gitDiffHtml(gitDir string, commitId string, commitURL string, exclude []string) (string, error) {
+	args := []string{"show", "--color=always", "--compact-summary", "--patch", "--pretty=format:%h|%B", commitId}
+	gitCmd := exec.Command("git", append(args, excludePathspecs(exclude)...)...)
 	var gitStderr bytes.Buffer
 	gitCmd.Stderr = &gitStderr
 	gitCmd.Dir = gitDir
@@ -80,35 +98,115 @@ func gitDiffHtml(gitDir string, commitId string, commitURL string) (string, erro
 	return coloredDiffToHtml(deltaOutput.String(), commitURL)
 }
 
-func commitToEmail(gitDir string, repo string, branch string, commit *github.HeadCommit) (*EmailMsg, error) {
-	config, err := getConfig(gitDir)
+// gitDiffText formats a commit as plain text, leaving the paths in exclude
+// out of the diff
+func gitDiffText(gitDir string, commitId string, commitURL string, exclude []string) (string, error) {
+	args := []string{"show", "--no-color", "--compact-summary", "--patch", commitId}
+	out, err := runGitCmd(gitDir, nil, append(args, excludePathspecs(exclude)...)...)
 	if err != nil {
-		return nil, fmt.Errorf("could not get config for %s: %w", repo, err)
+		return "", err
+	}
+	return commitURL + "\n\n" + string(out), nil
+}
+
+// commitToEmails creates the emails for a commit, one for each group of
+// recipients in the config.
+func commitToEmails(cfg AppConfig, config CommitEmailConfig, gitDir string, repo string, branch string, commit *github.HeadCommit) ([]EmailMsg, error) {
+	groups := config.CommitGroups()
+	var recipients []string
+	for _, group := range groups {
+		recipients = append(recipients, group.Envelope()...)
+	}
+	if owners := config.codeownersGroup(gitDir, repo, commit.GetID(), recipients); !owners.Empty() {
+		groups = append(groups, owners)
+	}
+	if len(groups) == 0 {
+		return nil, nil
 	}
-	to := config.MailingList
-	body, err := gitDiffHtml(gitDir, commit.GetID(), commit.GetURL())
+	subject, header := config.renderCommitTemplates(gitDir, repo, branch, commit)
+	var attachments []Attachment
+	if config.Email.AttachPatch {
+		patch, err := patchAttachment(gitDir, commit.GetID())
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, patch)
+	}
+	// binary files, LFS objects, and submodules are described instead of
+	// being diffed
+	changes, err := specialChanges(cfg.PersistPath, gitDir, repo, commit.GetID())
 	if err != nil {
-		return nil, err
+		slog.Warn("could not find binary changes",
+			slog.String("repo", repo),
+			slog.String("commit", commit.GetID()),
+			slog.String("error", err.Error()))
 	}
+	exclude := specialPaths(changes)
+	// bodies are rendered once per format
+	bodies := make(map[string]string)
+	var emails []EmailMsg
+	for _, group := range groups {
+		body, ok := bodies[group.Format]
+		if !ok {
+			var err error
+			if group.Format == "text" {
+				body, err = gitDiffText(gitDir, commit.GetID(), commit.GetURL(), exclude)
+				body += specialChangesText(changes)
+			} else {
+				body, err = gitDiffHtml(gitDir, commit.GetID(), commit.GetURL(), exclude)
+				body += specialChangesHtml(changes)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if header != "" {
+				if group.Format == "text" {
+					body = header + "\n\n" + body
+				} else {
+					body = fmt.Sprintf("<p style=\"white-space: pre-wrap\">%s</p>\n%s", html.EscapeString(header), body)
+				}
+			}
+			bodies[group.Format] = body
+		}
+		email := commitToEmail(cfg, repo, branch, commit)
+		if subject != "" {
+			email.Subject = subject
+		}
+		email.To = formatAddresses(group.To.addresses())
+		email.Cc = formatAddresses(group.Cc.addresses())
+		email.Rcpt = group.Envelope()
+		email.Format = group.Format
+		email.Body = body
+		email.Attachments = attachments
+		if group.Format != "text" {
+			// images are shown inline in html emails
+			email.Attachments = append(specialChangesImages(changes), attachments...)
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// commitToEmail fills in the headers of an email about commit
+func commitToEmail(cfg AppConfig, repo string, branch string, commit *github.HeadCommit) EmailMsg {
 	msg, _, _ := strings.Cut(commit.GetMessage(), "\n")
 	subject := fmt.Sprintf("%s %s: %s", repo, branch, msg)
 	fromName := commit.GetAuthor().GetName()
 
-	// the SMTP envelope FromAddr and the From header should match: if they
-	// don't, Gmail tends to send to spam and Outlook rewrites the from address
-	// to something really odd
-	fromAddr := NOTIFY_EMAIL
-	from := fmt.Sprintf("%s <%s>", fromName, fromAddr)
+	// the SMTP envelope FromAddr and the From header should match (which they
+	// do unless an envelope sender is configured): if they don't, Gmail tends
+	// to send to spam and Outlook rewrites the from address to something
+	// really odd
+	from := fmt.Sprintf("%s <%s>", fromName, cfg.NotifyEmail())
 	// the Reply-To can use the actual commiter's email
 	replyTo := fmt.Sprintf("%s <%s>", fromName, commit.GetAuthor().GetEmail())
-	email := &EmailMsg{
-		To:       to,
+	return EmailMsg{
 		From:     from,
-		FromAddr: fromAddr,
+		FromAddr: cfg.EnvelopeSender(),
 		ReplyTo:  replyTo,
 		Subject:  subject,
 		Date:     time.Now().Format(time.RFC1123Z),
-		Body:     body,
+		Commit:   commit.GetID(),
+		Branch:   branch,
 	}
-	return email, nil
 }
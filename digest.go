@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/go-github/v75/github"
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// how often the digest scheduler checks for due digests
+const DIGEST_CHECK_INTERVAL = time.Minute
+
+// digestPeriodStart returns the start of the digest period containing t. All
+// periods are aligned in UTC; weekly digests start on Monday.
+func digestPeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	switch period {
+	case "hourly":
+		return t.Truncate(time.Hour)
+	case "daily":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "weekly":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		daysSinceMonday := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -daysSinceMonday)
+	}
+	return t
+}
+
+// recordDigestCommits saves the commits in a push for the repo's next digest.
+func (h PushHandler) recordDigestCommits(gitDir string, config CommitEmailConfig, ev *github.PushEvent) {
+	branch := strings.TrimPrefix(ev.GetRef(), "refs/heads/")
+	var commits []stats.DigestCommit
+	for _, commit := range ev.Commits {
+		if !config.includeCommit(commit) {
+			continue
+		}
+		shortstat, err := GitShortStat(gitDir, commit.GetID())
+		if err != nil {
+			slog.Warn("could not get shortstat",
+				slog.String("repo", h.repo),
+				slog.String("commit", commit.GetID()),
+				slog.String("error", err.Error()))
+		}
+		subject, _, _ := strings.Cut(commit.GetMessage(), "\n")
+		commits = append(commits, stats.DigestCommit{
+			Branch:    branch,
+			SHA:       commit.GetID(),
+			Subject:   subject,
+			Author:    commit.GetAuthor().GetName(),
+			URL:       commit.GetURL(),
+			ShortStat: shortstat,
+		})
+	}
+	to, bcc := config.DigestRecipients()
+	err := h.srv.db.AddDigestCommits(h.repo, h.installation, config.Digest, config.Email.Format, to, strings.Join(bcc, ","), commits)
+	if err != nil {
+		slog.Error("could not record digest commits",
+			slog.String("repo", h.repo),
+			slog.String("error", err.Error()))
+	}
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`<html>
+<body>
+<p>{{len .Commits}} new commit(s) to {{.Repo}} since {{.Since}}</p>
+{{range .Branches}}
+<h3>{{.Name}}</h3>
+<ul>
+{{range .Commits}}<li><a href="{{.URL}}"><code>{{slice .SHA 0 8}}</code></a> {{.Subject}} ({{.Author}}){{if .ShortStat}}<br><small>{{.ShortStat}}</small>{{end}}</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>`))
+
+var digestTextTemplate = texttemplate.Must(texttemplate.New("digest-text").Parse(`{{len .Commits}} new commit(s) to {{.Repo}} since {{.Since}}
+{{range .Branches}}
+{{.Name}}:
+{{range .Commits}}  {{slice .SHA 0 8}} {{.Subject}} ({{.Author}})
+{{- if .ShortStat}}
+    {{.ShortStat}}{{end}}
+    {{.URL}}
+{{end}}{{end}}`))
+
+type digestBranch struct {
+	Name    string
+	Commits []stats.DigestCommit
+}
+
+func digestToEmail(cfg AppConfig, repo stats.DigestRepo, commits []stats.DigestCommit, now time.Time) (*EmailMsg, error) {
+	var branches []digestBranch
+	byName := make(map[string]int)
+	for _, c := range commits {
+		i, ok := byName[c.Branch]
+		if !ok {
+			i = len(branches)
+			byName[c.Branch] = i
+			branches = append(branches, digestBranch{Name: c.Branch})
+		}
+		branches[i].Commits = append(branches[i].Commits, c)
+	}
+	var body bytes.Buffer
+	data := struct {
+		Repo     string
+		Since    string
+		Commits  []stats.DigestCommit
+		Branches []digestBranch
+	}{
+		Repo:     repo.Repo,
+		Since:    repo.LastSent.UTC().Format("2006-01-02 15:04 MST"),
+		Commits:  commits,
+		Branches: branches,
+	}
+	var err error
+	if repo.Format == "text" {
+		err = digestTextTemplate.Execute(&body, data)
+	} else {
+		err = digestTemplate.Execute(&body, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &EmailMsg{
+		To:       repo.Recipients,
+		Rcpt:     append(headerAddresses(repo.Recipients), splitRecipients(repo.Bcc)...),
+		From:     fmt.Sprintf("commit-email-bot <%s>", cfg.NotifyEmail()),
+		FromAddr: cfg.EnvelopeSender(),
+		ReplyTo:  cfg.NotifyEmail(),
+		Subject:  fmt.Sprintf("%s %s digest: %d commit(s)", repo.Repo, repo.Period, len(commits)),
+		Date:     now.Format(time.RFC1123Z),
+		Format:   repo.Format,
+		Body:     body.String(),
+	}, nil
+}
+
+// sendDigest sends the digest for repo if one is due.
+func (srv Server) sendDigest(repo stats.DigestRepo, now time.Time) error {
+	if !repo.LastSent.Before(digestPeriodStart(repo.Period, now)) {
+		return nil
+	}
+	commits, err := srv.db.PendingDigestCommits(repo.Repo)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return srv.db.MarkDigestSent(repo.Repo, 0, now)
+	}
+	msgs, err := srv.digestMessages(repo, commits, now)
+	if err != nil {
+		return err
+	}
+	// queued and marked sent together, so a crash can't send it twice
+	if err := srv.db.QueueDigest(msgs, repo.Repo, commits[len(commits)-1].Id, now); err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		srv.notifyOutbox()
+		slog.Info("digest queued",
+			slog.String("repo", repo.Repo),
+			slog.Int("commits", len(commits)))
+	}
+	return nil
+}
+
+// digestMessages returns the outbox messages for a digest of commits, or none
+// if all of its recipients unsubscribed.
+func (srv Server) digestMessages(repo stats.DigestRepo, commits []stats.DigestCommit, now time.Time) ([]stats.OutboxMsg, error) {
+	email, err := digestToEmail(srv.cfg, repo, commits, now)
+	if err != nil {
+		return nil, err
+	}
+	email.Rcpt = srv.unsuppressedRecipients(repo.Repo, email.Rcpt)
+	if len(email.Rcpt) == 0 {
+		return nil, nil
+	}
+	email.NotBefore = srv.quietUntil(repo.Repo, now)
+	return srv.outboxMessages(repo.Installation, repo.Repo, []EmailMsg{*email}), nil
+}
+
+// disableDigest turns off digests for a repo whose config no longer has one,
+// sending its pending commits in a last digest rather than dropping them.
+func (h PushHandler) disableDigest() error {
+	repo, found, err := h.srv.db.GetDigestRepo(h.repo)
+	if err != nil || !found {
+		return err
+	}
+	commits, err := h.srv.db.PendingDigestCommits(h.repo)
+	if err != nil {
+		return err
+	}
+	var msgs []stats.OutboxMsg
+	if len(commits) > 0 {
+		msgs, err = h.srv.digestMessages(repo, commits, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	if err := h.srv.db.DisableDigest(msgs, h.repo); err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		h.srv.notifyOutbox()
+	}
+	slog.Info("digest disabled",
+		slog.String("repo", h.repo),
+		slog.Int("pending_commits", len(commits)))
+	return nil
+}
+
+// runDigests periodically sends all due digests, and the summaries of emails
+// held during quiet hours. Progress is kept in the database, so digests missed
+// while the server was down are sent on startup.
+func (srv Server) runDigests() {
+	for {
+		if err := srv.sendQuietSummaries(time.Now()); err != nil {
+			slog.Error("could not send quiet hours summaries", slog.String("error", err.Error()))
+		}
+		repos, err := srv.db.DigestRepos()
+		if err != nil {
+			slog.Error("could not list digest repos", slog.String("error", err.Error()))
+		}
+		for _, repo := range repos {
+			if err := srv.sendDigest(repo, time.Now()); err != nil {
+				slog.Warn("could not send digest",
+					slog.String("repo", repo.Repo),
+					slog.String("error", err.Error()))
+			}
+		}
+		time.Sleep(DIGEST_CHECK_INTERVAL)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// headers signed by default. Headers that are missing from a message are still
+// listed, which prevents them from being added after signing.
+var DKIM_DEFAULT_HEADERS = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	// RFC 8058 requires one-click unsubscribe headers to be signed
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// dkimSigner signs messages with DKIM (RFC 6376), using relaxed
+// canonicalization for both header and body. RSA and Ed25519 (RFC 8463) keys
+// are supported.
+type dkimSigner struct {
+	domain   string
+	selector string
+	headers  []string
+	key      crypto.Signer
+}
+
+// loadDKIMSigner creates a signer from the DKIM settings in cfg. The private
+// key is a PEM file (PKCS#1 or PKCS#8) given in cfg.DKIMPrivateKey, or
+// otherwise read from dkim.key in the persist path. Returns nil if DKIM is not
+// configured.
+func loadDKIMSigner(cfg AppConfig) (*dkimSigner, error) {
+	if cfg.DKIMSelector == "" {
+		return nil, nil
+	}
+	keyPEM := cfg.DKIMPrivateKey
+	if len(keyPEM) == 0 {
+		var err error
+		keyPEM, err = os.ReadFile(filepath.Join(cfg.PersistPath, "dkim.key"))
+		if err != nil {
+			return nil, fmt.Errorf("DKIM selector is set but no key found: %w", err)
+		}
+	}
+	key, err := parseDKIMKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	domain := cfg.DKIMDomain
+	if domain == "" {
+		domain = cfg.MailFromDomain
+	}
+	headers := DKIM_DEFAULT_HEADERS
+	if cfg.DKIMHeaders != "" {
+		headers = nil
+		for _, h := range strings.Split(cfg.DKIMHeaders, ":") {
+			if h = strings.TrimSpace(h); h != "" {
+				headers = append(headers, h)
+			}
+		}
+	}
+	hasFrom := false
+	for _, h := range headers {
+		hasFrom = hasFrom || strings.EqualFold(h, "From")
+	}
+	if !hasFrom {
+		return nil, fmt.Errorf("DKIM signed headers must include From")
+	}
+	return &dkimSigner{
+		domain:   domain,
+		selector: cfg.DKIMSelector,
+		headers:  headers,
+		key:      key,
+	}, nil
+}
+
+func parseDKIMKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("DKIM key is not in PEM format")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse DKIM key: %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+}
+
+func (s *dkimSigner) algorithm() string {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// Sign returns msg with a DKIM-Signature header added.
+func (s *dkimSigner) Sign(msg []byte) ([]byte, error) {
+	// messages use \n line endings, which are converted to CRLF when sent
+	crlf := bytes.ReplaceAll(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	header, body, ok := bytes.Cut(crlf, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = bytes.TrimSuffix(crlf, []byte("\r\n")), nil
+	}
+	fields := splitHeaderFields(string(header))
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+	sigValue := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n"+
+		"\tbh=%s;\r\n"+
+		"\tb=",
+		s.algorithm(), s.domain, s.selector,
+		time.Now().Unix(), strings.ToLower(strings.Join(s.headers, ":")),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	h.Write(dkimSelectHeaders(fields, s.headers))
+	// the signature header itself is signed with an empty b= tag, without a
+	// trailing CRLF
+	h.Write([]byte(dkimRelaxedHeader("DKIM-Signature:" + sigValue)))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		// RFC 8463: Ed25519 signs the SHA-256 hash, not the data itself
+		sig = ed25519.Sign(key, digest)
+	default:
+		sig, err = s.key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var signed bytes.Buffer
+	signed.WriteString("DKIM-Signature: ")
+	signed.WriteString(strings.ReplaceAll(sigValue, "\r\n", "\n"))
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 72 {
+		signed.WriteString(b[:72])
+		signed.WriteString("\n\t")
+		b = b[72:]
+	}
+	signed.WriteString(b)
+	signed.WriteString("\n")
+	signed.Write(msg)
+	return signed.Bytes(), nil
+}
+
+// splitHeaderFields splits a CRLF-separated header into fields, keeping
+// continuation lines with their field
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// dkimSelectHeaders returns the canonicalized headers to sign. Each name
+// selects the last field with that name not yet used; names with no remaining
+// field contribute nothing.
+func dkimSelectHeaders(fields []string, names []string) []byte {
+	used := make([]bool, len(fields))
+	var out bytes.Buffer
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			fieldName, _, _ := strings.Cut(fields[i], ":")
+			if used[i] || !strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				continue
+			}
+			used[i] = true
+			out.WriteString(dkimRelaxedHeader(fields[i]))
+			out.WriteString("\r\n")
+			break
+		}
+	}
+	return out.Bytes()
+}
+
+// dkimRelaxedHeader canonicalizes a header field with the relaxed algorithm
+// (RFC 6376 section 3.4.2), without the trailing CRLF
+func dkimRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// dkimRelaxedBody canonicalizes a CRLF-separated body with the relaxed
+// algorithm (RFC 6376 section 3.4.4)
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		// reduce whitespace runs to one space and remove trailing whitespace
+		var b strings.Builder
+		space := false
+		for _, c := range line {
+			if isWSP(c) {
+				space = true
+				continue
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteRune(c)
+		}
+		lines[i] = b.String()
+	}
+	// ignore empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(c rune) bool {
+	return c == ' ' || c == '\t'
+}
+
+// dkimMailer signs messages before passing them to another Mailer
+type dkimMailer struct {
+	Mailer
+	signer *dkimSigner
+}
+
+func (m dkimMailer) Send(from string, to []string, msg []byte) error {
+	signed, err := m.signer.Sign(msg)
+	if err != nil {
+		return err
+	}
+	return m.Mailer.Send(from, to, signed)
+}
+
+func (m dkimMailer) SendBatch(msgs []OutgoingMsg) []error {
+	signed := make([]OutgoingMsg, len(msgs))
+	for i, msg := range msgs {
+		signedMsg, err := m.signer.Sign(msg.Msg)
+		if err != nil {
+			// signing only fails if the key is unusable, which affects every
+			// message
+			errs := make([]error, len(msgs))
+			for j := range errs {
+				errs[j] = err
+			}
+			return errs
+		}
+		signed[i] = OutgoingMsg{From: msg.From, To: msg.To, Msg: signedMsg}
+	}
+	return sendBatch(m.Mailer, signed)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests verify signatures with their own implementation of RFC 6376
+// verification, rather than the signer's canonicalization functions.
+
+var wspRun = regexp.MustCompile(`[ \t]+`)
+
+// dkimTags splits a DKIM-Signature value into its tags, with folding
+// whitespace removed from the values
+func dkimTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		val = strings.NewReplacer("\r\n", "", " ", "", "\t", "").Replace(val)
+		tags[strings.TrimSpace(name)] = val
+	}
+	return tags
+}
+
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Trim(wspRun.ReplaceAllString(value, " "), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value
+}
+
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(wspRun.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// verifyDKIM checks the DKIM-Signature of msg (with \n line endings, as sent
+// to a Mailer) with a relaxed/relaxed signature from pub.
+func verifyDKIM(msg []byte, pub crypto.PublicKey) error {
+	crlf := strings.ReplaceAll(string(msg), "\n", "\r\n")
+	header, body, ok := strings.Cut(crlf, "\r\n\r\n")
+	if !ok {
+		return fmt.Errorf("message has no body")
+	}
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	sigIndex := -1
+	for i, field := range fields {
+		if strings.HasPrefix(strings.ToLower(field), "dkim-signature:") {
+			sigIndex = i
+			break
+		}
+	}
+	if sigIndex < 0 {
+		return fmt.Errorf("no DKIM-Signature")
+	}
+	sigField := fields[sigIndex]
+	_, sigValue, _ := strings.Cut(sigField, ":")
+	tags := dkimTags(sigValue)
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected tags v=%s c=%s", tags["v"], tags["c"])
+	}
+
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return fmt.Errorf("body hash does not match")
+	}
+
+	var signed strings.Builder
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			fieldName, _, _ := strings.Cut(fields[i], ":")
+			if i == sigIndex || used[i] || !strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				continue
+			}
+			used[i] = true
+			signed.WriteString(relaxedHeader(fields[i]) + "\r\n")
+			break
+		}
+	}
+	// the signature is verified with an empty b= tag (but not bh=)
+	emptyB := regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+	signed.WriteString(relaxedHeader("DKIM-Signature:" + emptyB.ReplaceAllString(sigValue, "$1$2")))
+	digest := sha256.Sum256([]byte(signed.String()))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid b= tag: %w", err)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("unexpected algorithm %s", tags["a"])
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return fmt.Errorf("unexpected algorithm %s", tags["a"])
+		}
+		if !ed25519.Verify(pub, digest[:], sig) {
+			return fmt.Errorf("ed25519 signature does not verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key %T", pub)
+}
+
+// testDKIMKeys returns signers loaded from PEM, as they would be configured,
+// with their public keys
+func testDKIMKeys(t *testing.T) map[string]struct {
+	signer *dkimSigner
+	pub    crypto.PublicKey
+} {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER})
+
+	keys := make(map[string]struct {
+		signer *dkimSigner
+		pub    crypto.PublicKey
+	})
+	for name, key := range map[string]struct {
+		pem []byte
+		pub crypto.PublicKey
+	}{"rsa": {rsaPEM, &rsaKey.PublicKey}, "ed25519": {edPEM, edPub}} {
+		signer, err := loadDKIMSigner(AppConfig{
+			MailFromDomain: "example.org",
+			DKIMSelector:   "mail",
+			DKIMPrivateKey: key.pem,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		keys[name] = struct {
+			signer *dkimSigner
+			pub    crypto.PublicKey
+		}{signer, key.pub}
+	}
+	return keys
+}
+
+func testDKIMMessages() map[string][]byte {
+	email := EmailMsg{
+		From:            "Jane Doe <notify@example.org>",
+		To:              "<dev@example.com>, \"Doe, John\" <john@example.com>",
+		Cc:              "<cc@example.com>",
+		ReplyTo:         "Jane Doe <jane@example.com>",
+		Subject:         "owner/repo main: Fix the  parser\t(again)",
+		Date:            time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Format(time.RFC1123Z),
+		MessageId:       "abc123@example.org",
+		ListUnsubscribe: "https://example.org/unsubscribe?addr=dev%40example.com",
+		Body:            "<pre>\ndiff --git a/f b/f\n+added line   \n\ttabbed\n</pre>\n\n\n",
+	}
+	text := email
+	text.Format = "text"
+	text.Body = "http://u\n\n" + strings.Repeat("a line with trailing space \n", 5)
+
+	// multipart/mixed with an inline image in a multipart/related part, as for
+	// binary changes, and an attached patch
+	multipart := email
+	multipart.Attachments = []Attachment{
+		{Name: "img.png", ContentType: "image/png", Data: bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 100), ContentID: "abc@commit-emails"},
+		{Name: "0001-Fix-the-parser.patch", ContentType: "text/x-patch; charset=UTF-8", Data: []byte("From abc\nSubject: [PATCH] Fix\n---\n")},
+	}
+
+	// a patch email replying to a cover letter
+	patch := text
+	patch.Subject = "[PATCH 2/3] Fix the parser"
+	patch.InReplyTo = "cover@example.org"
+
+	msgs := map[string][]byte{
+		"html":      renderEmail(email),
+		"text":      renderEmail(text),
+		"multipart": renderEmail(multipart),
+		"patch":     renderEmail(patch),
+	}
+	// headers folded over several lines
+	folded := renderEmail(email)
+	folded = bytes.Replace(folded, []byte("Subject: owner/repo main: Fix"), []byte("Subject: owner/repo\n main:\n\tFix"), 1)
+	folded = bytes.Replace(folded, []byte(", \"Doe, John\""), []byte(",\n    \"Doe, John\""), 1)
+	msgs["folded"] = folded
+	return msgs
+}
+
+func TestDKIMSignatures(t *testing.T) {
+	for keyName, key := range testDKIMKeys(t) {
+		for msgName, msg := range testDKIMMessages() {
+			t.Run(keyName+"/"+msgName, func(t *testing.T) {
+				signed, err := key.signer.Sign(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasSuffix(signed, msg) {
+					t.Fatal("signing changed the message")
+				}
+				if err := verifyDKIM(signed, key.pub); err != nil {
+					t.Fatalf("signature does not verify: %v\n%s", err, signed)
+				}
+			})
+		}
+	}
+}
+
+// TestDKIMRelaxed checks that signatures survive the changes relaxed
+// canonicalization allows, and not others.
+func TestDKIMRelaxed(t *testing.T) {
+	keys := testDKIMKeys(t)
+	msg := testDKIMMessages()["multipart"]
+	for keyName, key := range keys {
+		signed, err := key.signer.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			name     string
+			old, new string
+			valid    bool
+		}{
+			{"refolded subject", "Subject: owner/repo main:", "Subject:  owner/repo\n main:", true},
+			{"header name case", "Reply-To:", "REPLY-TO:", true},
+			{"trailing whitespace in body", "Content-Type: text/html; charset=UTF-8\n", "Content-Type: text/html; charset=UTF-8  \n", true},
+			{"trailing blank lines", "", "\n\n", true},
+			{"changed subject", "Fix the", "Fix a", false},
+			{"changed body", "+added line", "+removed line", false},
+			{"changed attachment", "Content-Disposition: attachment", "Content-Disposition: inline", false},
+		} {
+			t.Run(keyName+"/"+tt.name, func(t *testing.T) {
+				var changed []byte
+				if tt.old == "" {
+					changed = append(bytes.Clone(signed), tt.new...)
+				} else {
+					if !bytes.Contains(signed, []byte(tt.old)) {
+						t.Fatalf("message does not contain %q", tt.old)
+					}
+					changed = bytes.Replace(signed, []byte(tt.old), []byte(tt.new), 1)
+				}
+				err := verifyDKIM(changed, key.pub)
+				if tt.valid && err != nil {
+					t.Errorf("expected signature to verify: %v", err)
+				}
+				if !tt.valid && err == nil {
+					t.Errorf("expected signature to fail")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+
+	"github.com/google/go-github/v75/github"
+)
+
+// limits on email.subject and email.header templates, before and after
+// rendering
+const (
+	MAX_TEMPLATE_LEN = 1000
+	MAX_SUBJECT_LEN  = 200
+	MAX_HEADER_LEN   = 2000
+)
+
+// template functions allowed in email templates; the others (such as printf,
+// which can pad its output arbitrarily, and call) are rejected, as are range
+// loops and nested templates, so that rendering is cheap and bounded.
+var allowedTemplateFuncs = map[string]bool{
+	"and": true, "or": true, "not": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+	"len": true, "index": true, "slice": true,
+	"print": true, "html": true, "urlquery": true,
+}
+
+// CommitTemplateData is available to email.subject and email.header templates.
+type CommitTemplateData struct {
+	// Repo is the repository name, without the owner
+	Repo     string
+	Branch   string
+	SHA      string
+	ShortSHA string
+	// Subject is the first line of the commit message
+	Subject      string
+	Message      string
+	Author       string
+	AuthorEmail  string
+	FilesChanged int
+	Insertions   int
+	Deletions    int
+}
+
+// sampleTemplateData is used to check templates when the config is loaded.
+var sampleTemplateData = CommitTemplateData{
+	Repo:         "repo",
+	Branch:       "main",
+	SHA:          "0123456789abcdef0123456789abcdef01234567",
+	ShortSHA:     "0123456",
+	Subject:      "Fix a bug",
+	Message:      "Fix a bug\n\nWith more details.",
+	Author:       "Jane Doe",
+	AuthorEmail:  "jane@example.com",
+	FilesChanged: 2,
+	Insertions:   10,
+	Deletions:    3,
+}
+
+// parseEmailTemplate parses and checks a template from the config, which has
+// the given name (for errors).
+func parseEmailTemplate(name string, text string) (*template.Template, error) {
+	if len(text) > MAX_TEMPLATE_LEN {
+		return nil, fmt.Errorf("%s is too long (at most %d characters)", name, MAX_TEMPLATE_LEN)
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpl.Templates()) > 1 {
+		return nil, fmt.Errorf("%s: defining templates is not supported", name)
+	}
+	if err := checkTemplateNode(tmpl.Tree.Root); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if _, err := executeEmailTemplate(tmpl, sampleTemplateData, MAX_HEADER_LEN); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// checkTemplateNode rejects the template features that are not allowed in
+// email templates.
+func checkTemplateNode(node parse.Node) error {
+	switch node := node.(type) {
+	case nil:
+		return nil
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, n := range node.Nodes {
+			if err := checkTemplateNode(n); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkTemplateNode(node.Pipe)
+	case *parse.IfNode:
+		return checkBranchNode(&node.BranchNode)
+	case *parse.WithNode:
+		return checkBranchNode(&node.BranchNode)
+	case *parse.PipeNode:
+		if node == nil {
+			return nil
+		}
+		for _, cmd := range node.Cmds {
+			for _, arg := range cmd.Args {
+				if err := checkTemplateNode(arg); err != nil {
+					return err
+				}
+			}
+		}
+	case *parse.ChainNode:
+		return checkTemplateNode(node.Node)
+	case *parse.IdentifierNode:
+		if !allowedTemplateFuncs[node.Ident] {
+			return fmt.Errorf("function %s is not allowed", node.Ident)
+		}
+	case *parse.RangeNode:
+		return errors.New("range is not allowed")
+	case *parse.TemplateNode:
+		return errors.New("nested templates are not allowed")
+	case *parse.TextNode, *parse.CommentNode, *parse.FieldNode, *parse.VariableNode,
+		*parse.DotNode, *parse.NilNode, *parse.BoolNode, *parse.NumberNode, *parse.StringNode:
+	default:
+		return fmt.Errorf("unsupported template syntax: %s", node)
+	}
+	return nil
+}
+
+func checkBranchNode(node *parse.BranchNode) error {
+	if err := checkTemplateNode(node.Pipe); err != nil {
+		return err
+	}
+	if err := checkTemplateNode(node.List); err != nil {
+		return err
+	}
+	return checkTemplateNode(node.ElseList)
+}
+
+// limitedBuffer is a buffer that fails writes beyond its limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+var errTemplateTooLong = errors.New("output is too long")
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errTemplateTooLong
+	}
+	return b.Buffer.Write(p)
+}
+
+func executeEmailTemplate(tmpl *template.Template, data CommitTemplateData, limit int) (string, error) {
+	buf := limitedBuffer{limit: limit}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		if errors.Is(err, errTemplateTooLong) {
+			return "", fmt.Errorf("%s: output is longer than %d bytes", tmpl.Name(), limit)
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderSubject renders an email.subject template as a single header line of
+// at most MAX_SUBJECT_LEN characters.
+func renderSubject(tmpl *template.Template, data CommitTemplateData) (string, error) {
+	// render a bit more than the limit, so long subjects are truncated rather
+	// than rejected
+	out, err := executeEmailTemplate(tmpl, data, 4*MAX_SUBJECT_LEN)
+	if err != nil {
+		return "", err
+	}
+	subject := strings.Join(strings.Fields(out), " ")
+	if utf8.RuneCountInString(subject) > MAX_SUBJECT_LEN {
+		subject = string([]rune(subject)[:MAX_SUBJECT_LEN-3]) + "..."
+	}
+	return subject, nil
+}
+
+// diffStats returns the number of files changed, lines inserted, and lines
+// deleted by a commit.
+func diffStats(gitDir string, commitId string) (files, insertions, deletions int, err error) {
+	out, err := runGitCmd(gitDir, nil, "show", "--numstat", "--format=", commitId)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		files++
+		// binary files have - for both counts
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			insertions += n
+		}
+		if n, err := strconv.Atoi(fields[1]); err == nil {
+			deletions += n
+		}
+	}
+	return files, insertions, deletions, nil
+}
+
+// renderCommitTemplates renders the email.subject and email.header templates
+// for commit. Either is "" if it is not configured or fails to render, in
+// which case the default subject and no header are used.
+func (c CommitEmailConfig) renderCommitTemplates(gitDir string, repo string, branch string, commit *github.HeadCommit) (subject string, header string) {
+	if c.subjectTmpl == nil && c.headerTmpl == nil {
+		return "", ""
+	}
+	firstLine, _, _ := strings.Cut(commit.GetMessage(), "\n")
+	data := CommitTemplateData{
+		Repo:        repo,
+		Branch:      branch,
+		SHA:         commit.GetID(),
+		ShortSHA:    shortSHA(commit.GetID()),
+		Subject:     firstLine,
+		Message:     commit.GetMessage(),
+		Author:      commit.GetAuthor().GetName(),
+		AuthorEmail: commit.GetAuthor().GetEmail(),
+	}
+	var err error
+	data.FilesChanged, data.Insertions, data.Deletions, err = diffStats(gitDir, commit.GetID())
+	if err != nil {
+		slog.Warn("could not get diff stats",
+			slog.String("repo", repo),
+			slog.String("commit", commit.GetID()),
+			slog.String("error", err.Error()))
+	}
+	if c.subjectTmpl != nil {
+		subject, err = renderSubject(c.subjectTmpl, data)
+		if err != nil {
+			slog.Warn("could not render email.subject",
+				slog.String("repo", repo),
+				slog.String("error", err.Error()))
+		}
+	}
+	if c.headerTmpl != nil {
+		header, err = executeEmailTemplate(c.headerTmpl, data, MAX_HEADER_LEN)
+		if err != nil {
+			slog.Warn("could not render email.header",
+				slog.String("repo", repo),
+				slog.String("error", err.Error()))
+		}
+	}
+	return subject, strings.TrimSpace(header)
+}
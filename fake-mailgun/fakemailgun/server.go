@@ -0,0 +1,128 @@
+// Package fakemailgun is a local stand-in for Mailgun's messages API, used by
+// the fake-mailgun command and by tests of the mailgun-api mailer.
+package fakemailgun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Message is a message accepted by the server
+type Message struct {
+	Id     string
+	Domain string
+	To     []string
+	Msg    []byte
+}
+
+// Server handles POST /v3/<domain>/messages.mime like Mailgun does.
+type Server struct {
+	// APIKey is the key requests must authenticate with
+	APIKey string
+	// Dir is where accepted messages are saved, if set
+	Dir string
+	// Out is where accepted messages are printed, if Dir is not set (nothing
+	// is printed if it is nil)
+	Out io.Writer
+	// Throttle and Fail respond 429 Too Many Requests and 503 Service
+	// Unavailable (respectively) to every Nth request, if set
+	Throttle int
+	Fail     int
+	// RetryAfter is the Retry-After header sent when throttling
+	RetryAfter string
+
+	requests atomic.Int64
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Requests is the number of requests the server has received
+func (s *Server) Requests() int {
+	return int(s.requests.Load())
+}
+
+// Messages returns the messages the server has accepted
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v3/{domain}/messages.mime", s.handleMessage)
+	return mux
+}
+
+func (s *Server) handleMessage(w http.ResponseWriter, req *http.Request) {
+	n := s.requests.Add(1)
+	user, key, ok := req.BasicAuth()
+	if !ok || user != "api" || key != s.APIKey {
+		http.Error(w, "Forbidden", http.StatusUnauthorized)
+		return
+	}
+	if s.Throttle > 0 && n%int64(s.Throttle) == 0 {
+		retryAfter := s.RetryAfter
+		if retryAfter == "" {
+			retryAfter = "1"
+		}
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	if s.Fail > 0 && n%int64(s.Fail) == 0 {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := req.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "invalid form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := req.MultipartForm.Value["to"]
+	if len(to) == 0 {
+		http.Error(w, "'to' parameter is missing", http.StatusBadRequest)
+		return
+	}
+	f, _, err := req.FormFile("message")
+	if err != nil {
+		http.Error(w, "'message' parameter is missing", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	msg, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	domain := req.PathValue("domain")
+	id := fmt.Sprintf("%d.%s", len(s.messages)+1, domain)
+	s.messages = append(s.messages, Message{Id: id, Domain: domain, To: to, Msg: msg})
+	s.mu.Unlock()
+	if s.Dir != "" {
+		err := os.WriteFile(filepath.Join(s.Dir, id+".eml"), msg, 0660)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if s.Out != nil {
+		fmt.Fprintf(s.Out, "To: %s\n%s\n", strings.Join(to, ", "), msg)
+	}
+	if s.Out != nil || s.Dir != "" {
+		log.Printf("accepted message %s for %s", id, strings.Join(to, ", "))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"id":      "<" + id + ">",
+		"message": "Queued. Thank you.",
+	})
+}
@@ -0,0 +1,40 @@
+// fake-mailgun is a local stand-in for Mailgun's messages API, for trying out
+// the mailgun-api mailer without sending real email. Run the bot with
+// -mailer mailgun-api -mail-api-url http://localhost:8025 and MAIL_API_KEY
+// set to the same key.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/tchajed/commit-emails-bot/fake-mailgun/fakemailgun"
+)
+
+func main() {
+	port := flag.String("port", "8025", "port to listen on")
+	apiKey := flag.String("key", "test-key", "API key to accept")
+	dir := flag.String("dir", "", "directory to save messages to (default: print to stdout)")
+	throttle := flag.Int("throttle", 0, "respond 429 Too Many Requests to every Nth request")
+	fail := flag.Int("fail", 0, "respond 503 Service Unavailable to every Nth request")
+	flag.Parse()
+
+	if *dir != "" {
+		if err := os.MkdirAll(*dir, 0770); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	srv := &fakemailgun.Server{
+		APIKey:   *apiKey,
+		Dir:      *dir,
+		Out:      os.Stdout,
+		Throttle: *throttle,
+		Fail:     *fail,
+	}
+	fmt.Printf("listening on localhost:%s\n", *port)
+	log.Fatal(http.ListenAndServe(":"+*port, srv.Handler()))
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v75/github"
 )
 
-func repoGitDir(persistPath string, repo *github.PushEventRepository) string {
-	return filepath.Join(persistPath, "repos", "github.com", *repo.FullName)
+// repoGitDir is where the bare clone of a repo (given by its full name) is kept
+func repoGitDir(persistPath string, fullName string) string {
+	return filepath.Join(persistPath, "repos", "github.com", fullName)
 }
 
 // We authenticate to GitHub using an installation access token, acting as the
@@ -39,19 +43,9 @@ func tokenToParams(token string) []gitConfigParam {
 	}}
 }
 
+// SyncRepo clones or fetches a bare mirror of repo, returning its git
+// directory.
 func SyncRepo(ctx context.Context, client *github.Client, repo *github.PushEventRepository, persistPath string) (gitDir string, err error) {
-	_, _, _, err = client.Repositories.GetContents(ctx, *repo.Owner.Login, *repo.Name, ".github/commit-emails.toml", nil)
-	if err != nil {
-		if _, ok := err.(*github.RateLimitError); ok {
-			return "", fmt.Errorf("rate limit error: %s", err)
-		}
-		if _, ok := err.(*github.AbuseRateLimitError); ok {
-			return "", fmt.Errorf("abuse limit error: %s", err)
-		}
-		// TODO: only do this for 404
-		return "", MissingConfigError{}
-	}
-
 	// Get authentication token if available, otherwise use unauthenticated access
 	var params []gitConfigParam
 	if transport := client.Client().Transport; transport != nil {
@@ -64,7 +58,7 @@ func SyncRepo(ctx context.Context, client *github.Client, repo *github.PushEvent
 		}
 	}
 
-	gitDir = repoGitDir(persistPath, repo)
+	gitDir = repoGitDir(persistPath, *repo.FullName)
 	fi, err := os.Stat(gitDir)
 	if os.IsNotExist(err) {
 		err := gitClone(*repo.CloneURL, gitDir, params)
@@ -90,6 +84,75 @@ func GitShow(gitDir, ref, path string) ([]byte, error) {
 	return runGitCmd(gitDir, nil, "show", ref+":"+path)
 }
 
+// GitObjectId resolves a revision (such as HEAD:path) to an object id
+func GitObjectId(gitDir, rev string) (string, error) {
+	out, err := runGitCmd(gitDir, nil, "rev-parse", "--verify", "--quiet", rev)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// GitShortStat returns the summary line of changes in a commit, such as "2
+// files changed, 10 insertions(+), 3 deletions(-)"
+func GitShortStat(gitDir, commitId string) (string, error) {
+	out, err := runGitCmd(gitDir, nil, "show", "--shortstat", "--format=", commitId)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitObjects returns the objects with the given ids (which should exist) from
+// git cat-file, by id. With contents false, the objects are read with
+// --batch-check and only their sizes are filled in.
+func gitObjects(gitDir string, ids []string, contents bool) (map[string]gitObject, error) {
+	objects := make(map[string]gitObject)
+	if len(ids) == 0 {
+		return objects, nil
+	}
+	batch := "--batch-check"
+	if contents {
+		batch = "--batch"
+	}
+	out, err := runGitCmdInput(gitDir, nil, []byte(strings.Join(ids, "\n")+"\n"), "cat-file", batch)
+	if err != nil {
+		return nil, err
+	}
+	for len(out) > 0 {
+		// each object is "<id> <type> <size>\n", followed by "<contents>\n"
+		// for --batch
+		header, rest, _ := bytes.Cut(out, []byte("\n"))
+		out = rest
+		fields := strings.Fields(string(header))
+		if len(fields) != 3 {
+			// "<id> missing"
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected cat-file output %q", header)
+		}
+		obj := gitObject{Type: fields[1], Size: size}
+		if contents {
+			if int64(len(out)) < size+1 {
+				return nil, fmt.Errorf("cat-file output for %s is truncated", fields[0])
+			}
+			obj.Data = out[:size]
+			out = out[size+1:]
+		}
+		objects[fields[0]] = obj
+	}
+	return objects, nil
+}
+
+type gitObject struct {
+	Type string
+	Size int64
+	// Data is the object's contents, if they were read
+	Data []byte
+}
+
 type gitConfigParam struct {
 	Key   string
 	Value string
@@ -106,9 +169,19 @@ func gitFetch(gitDir string, params []gitConfigParam) error {
 }
 
 func runGitCmd(gitDir string, params []gitConfigParam, args ...string) ([]byte, error) {
+	return runGitCmdInput(gitDir, params, nil, args...)
+}
+
+// runGitCmdInput is runGitCmd with input for the command's stdin
+func runGitCmdInput(gitDir string, params []gitConfigParam, input []byte, args ...string) ([]byte, error) {
 	cmd := exec.Command("git", args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "GIT_DIR="+gitDir)
+	// fail rather than prompt for credentials for a repo we can't access
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
 	// GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n>, GIT_CONFIG_VALUE_<n>, ... are a
 	// feature to pass configuration options by environment variables. There's
 	// also GIT_CONFIG_PARAMETERS, but it's hard to encode arbitrary values with
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/go-github/v75/github"
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+const NUM_JOB_WORKERS = 4
+const MAX_JOB_ATTEMPTS = 5
+
+// how long finished jobs are kept, so they can be resent
+const JOB_RETENTION = 30 * 24 * time.Hour
+
+// time limit for processing a single push (clone, render, and send)
+const JOB_TIMEOUT = 5 * time.Minute
+
+// how often idle workers check for jobs whose retry time has arrived
+const JOB_POLL_INTERVAL = 10 * time.Second
+
+// jobBackoff is the delay before retrying a job that has failed attempts
+// times: 30s, 1m, 2m, ...
+func jobBackoff(attempts int) time.Duration {
+	return 30 * time.Second << (attempts - 1)
+}
+
+// queueJob persists a webhook delivery and wakes up a worker to process it.
+func (srv Server) queueJob(deliveryId string, eventType string, payload []byte) error {
+	added, err := srv.db.AddJob(deliveryId, eventType, payload)
+	if err != nil {
+		return err
+	}
+	if !added {
+		slog.Info("delivery already queued", slog.String("delivery", deliveryId))
+		return nil
+	}
+	srv.notifyJobs()
+	return nil
+}
+
+func (srv Server) notifyJobs() {
+	select {
+	case srv.jobs <- struct{}{}:
+	default:
+	}
+}
+
+// startJobWorkers starts the pool of workers processing queued jobs. Jobs
+// interrupted by a previous shutdown are retried, and finished jobs are
+// deleted after JOB_RETENTION.
+func (srv Server) startJobWorkers() {
+	if err := srv.db.ResetRunningJobs(); err != nil {
+		slog.Error("could not reset running jobs", slog.String("error", err.Error()))
+	}
+	for i := 0; i < NUM_JOB_WORKERS; i++ {
+		go srv.jobWorker()
+	}
+	go func() {
+		for {
+			if err := srv.db.PruneJobs(time.Now().Add(-JOB_RETENTION)); err != nil {
+				slog.Warn("could not prune jobs", slog.String("error", err.Error()))
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+	srv.notifyJobs()
+}
+
+func (srv Server) jobWorker() {
+	ticker := time.NewTicker(JOB_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		job, err := srv.db.ClaimJob(time.Now())
+		if err != nil {
+			slog.Error("could not claim job", slog.String("error", err.Error()))
+		}
+		if job == nil {
+			select {
+			case <-srv.jobs:
+			case <-ticker.C:
+			}
+			continue
+		}
+		srv.runJob(job)
+		// there may be more work queued behind this job
+		srv.notifyJobs()
+	}
+}
+
+func (srv Server) runJob(job *stats.Job) {
+	err := srv.processJob(job)
+	if err == nil {
+		if err := srv.db.FinishJob(job.Id, "done", nil); err != nil {
+			slog.Error("could not finish job", slog.String("error", err.Error()))
+		}
+		return
+	}
+	if job.Attempts >= MAX_JOB_ATTEMPTS {
+		slog.Error("job failed",
+			slog.String("delivery", job.DeliveryId),
+			slog.Int("attempts", job.Attempts),
+			slog.String("error", err.Error()))
+		err = srv.db.FinishJob(job.Id, "failed", err)
+	} else {
+		delay := jobBackoff(job.Attempts)
+		slog.Warn("job will be retried",
+			slog.String("delivery", job.DeliveryId),
+			slog.Int("attempts", job.Attempts),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()))
+		err = srv.db.RetryJob(job.Id, time.Now().Add(delay), err)
+	}
+	if err != nil {
+		slog.Error("could not update job", slog.String("error", err.Error()))
+	}
+}
+
+func (srv Server) processJob(job *stats.Job) error {
+	event, err := github.ParseWebHook(job.EventType, job.Payload)
+	if err != nil {
+		return fmt.Errorf("could not parse webhook: %w", err)
+	}
+	switch event := event.(type) {
+	case *github.PushEvent:
+		ctx, cancel := context.WithTimeout(context.Background(), JOB_TIMEOUT)
+		defer cancel()
+		repo := event.GetRepo().GetFullName()
+		err := PushHandler{
+			srv:          srv,
+			installation: event.GetInstallation().GetID(),
+			repo:         repo,
+			force:        job.Force,
+		}.githubPushHandler(ctx, event)
+		if err != nil {
+			return fmt.Errorf("push handler failed: %w", err)
+		}
+		srv.db.AddPush(event)
+		before := (*event.Before)[:8]
+		after := (*event.After)[:8]
+		slog.Info("push success",
+			slog.String("repo", repo),
+			slog.String("delivery", job.DeliveryId),
+			slog.String("ref change", fmt.Sprintf("%s: %s -> %s", event.GetRef(), before, after)),
+		)
+		return nil
+	default:
+		return fmt.Errorf("unexpected event type %s", job.EventType)
+	}
+}
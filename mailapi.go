@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// number of times a request is retried when the API is throttling or
+// temporarily failing, before leaving it to the outbox to retry later
+const MAIL_API_RETRIES = 3
+
+// longest Retry-After the API mailer waits for before giving up
+const MAIL_API_MAX_WAIT = 30 * time.Second
+
+// mailgunAPIMailer delivers messages with Mailgun's HTTP API for sending
+// pre-built MIME messages (POST /v3/<domain>/messages.mime), for hosts where
+// outgoing SMTP is blocked.
+type mailgunAPIMailer struct {
+	baseURL string
+	domain  string
+	apiKey  string
+	client  *http.Client
+	// sleep waits between retries (time.Sleep, except in tests)
+	sleep func(time.Duration)
+}
+
+func newMailgunAPIMailer(cfg AppConfig) (*mailgunAPIMailer, error) {
+	if cfg.MailAPIKey == "" {
+		return nil, fmt.Errorf("mailgun-api mailer needs an API key (MAIL_API_KEY)")
+	}
+	domain := cfg.MailAPIDomain
+	if domain == "" {
+		domain = cfg.MailFromDomain
+	}
+	return &mailgunAPIMailer{
+		baseURL: strings.TrimSuffix(cfg.MailAPIURL, "/"),
+		domain:  domain,
+		apiKey:  cfg.MailAPIKey,
+		client:  &http.Client{Timeout: time.Minute},
+		sleep:   time.Sleep,
+	}, nil
+}
+
+// mailAPIError is an error response from an HTTP mail API
+type mailAPIError struct {
+	StatusCode int
+	Body       string
+	// how long the server asked us to wait before retrying (0 if not given)
+	RetryAfter time.Duration
+}
+
+func (e *mailAPIError) Error() string {
+	return fmt.Sprintf("mail API returned %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports if the request may succeed if retried later
+func (e *mailAPIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (m *mailgunAPIMailer) Send(from string, to []string, msg []byte) error {
+	var err error
+	for attempt := 0; attempt <= MAIL_API_RETRIES; attempt++ {
+		err = m.post(to, msg)
+		apiErr, ok := err.(*mailAPIError)
+		if !ok || !apiErr.Temporary() || attempt == MAIL_API_RETRIES {
+			return err
+		}
+		wait := apiErr.RetryAfter
+		if wait == 0 {
+			wait = time.Second << attempt
+		}
+		if wait > MAIL_API_MAX_WAIT {
+			return err
+		}
+		m.sleep(wait)
+	}
+	return err
+}
+
+func (m *mailgunAPIMailer) post(to []string, msg []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, addr := range to {
+		if err := w.WriteField("to", addr); err != nil {
+			return err
+		}
+	}
+	part, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/v3/%s/messages.mime", m.baseURL, m.domain)
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.SetBasicAuth("api", m.apiKey)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	apiErr := &mailAPIError{
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(respBody)),
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return apiErr
+}
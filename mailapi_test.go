@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tchajed/commit-emails-bot/fake-mailgun/fakemailgun"
+)
+
+// newTestAPIMailer starts a fake Mailgun API and returns a mailer for it,
+// configured with apiKey. Waits between retries are recorded instead of slept.
+func newTestAPIMailer(t *testing.T, fake *fakemailgun.Server, apiKey string) (*mailgunAPIMailer, *[]time.Duration) {
+	server := httptest.NewServer(fake.Handler())
+	t.Cleanup(server.Close)
+	m, err := newMailgunAPIMailer(AppConfig{
+		MailFromDomain: "example.org",
+		MailAPIURL:     server.URL + "/",
+		MailAPIKey:     apiKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var waits []time.Duration
+	m.sleep = func(d time.Duration) { waits = append(waits, d) }
+	return m, &waits
+}
+
+var testAPIMsg = []byte("From: a@example.org\nTo: b@example.com\nSubject: hi\n\nbody\n")
+
+func TestMailAPISend(t *testing.T) {
+	fake := &fakemailgun.Server{APIKey: "key-1"}
+	m, waits := newTestAPIMailer(t, fake, "key-1")
+	to := []string{"b@example.com", "c@example.com"}
+	if err := m.Send("a@example.org", to, testAPIMsg); err != nil {
+		t.Fatal(err)
+	}
+	msgs := fake.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if msgs[0].Domain != "example.org" {
+		t.Errorf("sent to domain %s", msgs[0].Domain)
+	}
+	if !reflect.DeepEqual(msgs[0].To, to) {
+		t.Errorf("sent to %v, expected %v", msgs[0].To, to)
+	}
+	if !bytes.Equal(msgs[0].Msg, testAPIMsg) {
+		t.Errorf("message changed:\n%s", msgs[0].Msg)
+	}
+	if len(*waits) != 0 {
+		t.Errorf("unexpected retries: %v", *waits)
+	}
+}
+
+func TestMailAPIAuth(t *testing.T) {
+	fake := &fakemailgun.Server{APIKey: "key-1"}
+	m, _ := newTestAPIMailer(t, fake, "wrong-key")
+	err := m.Send("a@example.org", []string{"b@example.com"}, testAPIMsg)
+	var apiErr *mailAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", err)
+	}
+	if !isPermanentSendError(err) {
+		t.Errorf("auth failure should be permanent")
+	}
+	if fake.Requests() != 1 {
+		t.Errorf("expected no retries, got %d requests", fake.Requests())
+	}
+	if len(fake.Messages()) != 0 {
+		t.Errorf("message was accepted without the right key")
+	}
+}
+
+func TestMailAPIClientError(t *testing.T) {
+	fake := &fakemailgun.Server{APIKey: "key-1"}
+	m, waits := newTestAPIMailer(t, fake, "key-1")
+	// the API requires recipients
+	err := m.Send("a@example.org", nil, testAPIMsg)
+	var apiErr *mailAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", err)
+	}
+	if !isPermanentSendError(err) {
+		t.Errorf("400 should be permanent")
+	}
+	if fake.Requests() != 1 || len(*waits) != 0 {
+		t.Errorf("permanent failure was retried")
+	}
+}
+
+func TestMailAPIRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		fake *fakemailgun.Server
+		// waits before the second message is accepted
+		waits []time.Duration
+	}{
+		{"503", &fakemailgun.Server{APIKey: "key-1", Fail: 2}, []time.Duration{time.Second}},
+		{"429", &fakemailgun.Server{APIKey: "key-1", Throttle: 2, RetryAfter: "5"}, []time.Duration{5 * time.Second}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, waits := newTestAPIMailer(t, tt.fake, "key-1")
+			// the second request fails, and is retried
+			for i := 0; i < 2; i++ {
+				if err := m.Send("a@example.org", []string{"b@example.com"}, testAPIMsg); err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+			}
+			if len(tt.fake.Messages()) != 2 {
+				t.Errorf("expected 2 messages, got %d", len(tt.fake.Messages()))
+			}
+			if tt.fake.Requests() != 3 {
+				t.Errorf("expected 3 requests, got %d", tt.fake.Requests())
+			}
+			if !reflect.DeepEqual(*waits, tt.waits) {
+				t.Errorf("waited %v, expected %v", *waits, tt.waits)
+			}
+		})
+	}
+}
+
+func TestMailAPIRetriesExhausted(t *testing.T) {
+	fake := &fakemailgun.Server{APIKey: "key-1", Fail: 1}
+	m, waits := newTestAPIMailer(t, fake, "key-1")
+	err := m.Send("a@example.org", []string{"b@example.com"}, testAPIMsg)
+	var apiErr *mailAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", err)
+	}
+	// the outbox retries it later
+	if isPermanentSendError(err) {
+		t.Errorf("503 should not be permanent")
+	}
+	if fake.Requests() != MAIL_API_RETRIES+1 {
+		t.Errorf("expected %d requests, got %d", MAIL_API_RETRIES+1, fake.Requests())
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if !reflect.DeepEqual(*waits, expected) {
+		t.Errorf("waited %v, expected %v", *waits, expected)
+	}
+}
+
+func TestMailAPIRetryAfterTooLong(t *testing.T) {
+	fake := &fakemailgun.Server{APIKey: "key-1", Throttle: 1, RetryAfter: "3600"}
+	m, waits := newTestAPIMailer(t, fake, "key-1")
+	err := m.Send("a@example.org", []string{"b@example.com"}, testAPIMsg)
+	var apiErr *mailAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %v", err)
+	}
+	if fake.Requests() != 1 || len(*waits) != 0 {
+		t.Errorf("should give up rather than wait an hour")
+	}
+}
@@ -9,10 +9,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"net/smtp"
+	"net/textproto"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -39,18 +42,72 @@ type AppConfig struct {
 	Port        string
 
 	EmailStdout   bool
+	Mailer        string // how to deliver email (see newMailer)
 	WebhookSecret []byte
-	SmtpPassword  string
 	AppId         int64
 	AppPrivateKey []byte
+	// bearer token for /admin endpoints (disabled if empty)
+	AdminToken string
+
+	SmtpHost     string
+	SmtpPort     string
+	SmtpUser     string
+	SmtpPassword string
+	// "tls" (implicit TLS), "starttls", or "none"
+	SmtpTLS string
+	// skip verifying the server's certificate
+	SmtpTLSInsecure bool
+	// PEM file with CA certificates to verify the server with
+	SmtpCAFile string
+	// "plain", "login", "cram-md5", or "none"
+	SmtpAuth string
+
+	// emails are sent from notify@<MailFromDomain>
+	MailFromDomain string
+	// SMTP envelope sender, if it should differ from the From address
+	EnvelopeFrom string
+
+	// settings for the mailgun-api mailer
+	MailAPIURL    string
+	MailAPIKey    string
+	MailAPIDomain string
+
+	// maximum emails per hour for each installation, repository, and
+	// recipient (0 for no limit)
+	RateLimitInstallation int
+	RateLimitRepo         int
+	RateLimitRecipient    int
+
+	// DKIM signing is enabled if a selector is set (see loadDKIMSigner)
+	DKIMSelector   string
+	DKIMDomain     string
+	DKIMPrivateKey []byte
+	// colon-separated list of headers to sign
+	DKIMHeaders string
+
+	// hold emails to an address until it confirms it wants them
+	RequireOptIn bool
+	// key for verifying bounce and complaint webhooks (disabled if empty)
+	MailEventsKey string
+	// post a commit status when a push changes the config to or from invalid
+	// (requires the statuses permission)
+	ConfigStatus bool
 
 	DenyAccounts map[string]bool
 }
 
-const SMTP_HOST = "smtp.mailgun.org"
-const SMTP_ADDR = "smtp.mailgun.org:2525"
-const SMTP_USER = "postmaster@mail.commit-emails.xyz"
-const NOTIFY_EMAIL = "notify@mail.commit-emails.xyz"
+// NotifyEmail is the address emails are sent from
+func (cfg AppConfig) NotifyEmail() string {
+	return "notify@" + cfg.MailFromDomain
+}
+
+// EnvelopeSender is the SMTP envelope sender (the return path) for emails
+func (cfg AppConfig) EnvelopeSender() string {
+	if cfg.EnvelopeFrom != "" {
+		return cfg.EnvelopeFrom
+	}
+	return cfg.NotifyEmail()
+}
 
 func readEnvConfig(cfg *AppConfig) {
 	// If dotenvx is not used, an environment variable might still be encrypted.
@@ -74,7 +131,35 @@ func readEnvConfig(cfg *AppConfig) {
 	// alias for 443
 	cfg.Port = "https"
 	cfg.WebhookSecret = []byte(getEncryptedEnv("WEBHOOK_SECRET"))
+	getEnvDefault := func(varName string, def string) string {
+		if val := os.Getenv(varName); val != "" {
+			return val
+		}
+		return def
+	}
+	cfg.SmtpHost = getEnvDefault("MAIL_SMTP_HOST", "smtp.mailgun.org")
+	cfg.SmtpPort = getEnvDefault("MAIL_SMTP_PORT", "2525")
+	cfg.SmtpUser = getEnvDefault("MAIL_SMTP_USER", "postmaster@mail.commit-emails.xyz")
 	cfg.SmtpPassword = getEncryptedEnv("MAIL_SMTP_PASSWORD")
+	cfg.SmtpTLS = getEnvDefault("MAIL_SMTP_TLS", "starttls")
+	smtpInsecure := os.Getenv("MAIL_SMTP_TLS_INSECURE")
+	cfg.SmtpTLSInsecure = smtpInsecure == "true" || smtpInsecure == "1"
+	cfg.SmtpCAFile = os.Getenv("MAIL_SMTP_CA_FILE")
+	cfg.SmtpAuth = getEnvDefault("MAIL_SMTP_AUTH", "plain")
+	cfg.MailFromDomain = getEnvDefault("MAIL_FROM_DOMAIN", "mail.commit-emails.xyz")
+	cfg.EnvelopeFrom = os.Getenv("MAIL_ENVELOPE_FROM")
+	cfg.MailAPIURL = getEnvDefault("MAIL_API_URL", "https://api.mailgun.net")
+	cfg.MailAPIKey = getEncryptedEnv("MAIL_API_KEY")
+	cfg.MailAPIDomain = os.Getenv("MAIL_API_DOMAIN")
+	cfg.DKIMSelector = os.Getenv("DKIM_SELECTOR")
+	cfg.DKIMDomain = os.Getenv("DKIM_DOMAIN")
+	cfg.DKIMHeaders = os.Getenv("DKIM_HEADERS")
+	cfg.AdminToken = getEncryptedEnv("ADMIN_TOKEN")
+	cfg.MailEventsKey = getEncryptedEnv("MAIL_EVENTS_KEY")
+	cfg.Mailer = os.Getenv("MAILER")
+	cfg.RequireOptIn = os.Getenv("REQUIRE_OPT_IN") == "true" || os.Getenv("REQUIRE_OPT_IN") == "1"
+	configStatus := os.Getenv("CONFIG_STATUS")
+	cfg.ConfigStatus = configStatus == "true" || configStatus == "1"
 	emailStdout := os.Getenv("EMAIL_STDOUT")
 	if emailStdout == "true" || emailStdout == "1" {
 		cfg.EmailStdout = true
@@ -97,6 +182,29 @@ func readEnvConfig(cfg *AppConfig) {
 			log.Fatal("private key has invalid base64")
 		}
 	}
+
+	getEnvInt := func(varName string, def int) int {
+		val := os.Getenv(varName)
+		if val == "" {
+			return def
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			log.Fatalf("%s is not a number, got %s", varName, val)
+		}
+		return n
+	}
+	cfg.RateLimitInstallation = getEnvInt("RATE_LIMIT_INSTALLATION", 500)
+	cfg.RateLimitRepo = getEnvInt("RATE_LIMIT_REPO", 200)
+	cfg.RateLimitRecipient = getEnvInt("RATE_LIMIT_RECIPIENT", 100)
+
+	dkimKeyEncoded := getEncryptedEnv("DKIM_PRIVATE_KEY")
+	if dkimKeyEncoded != "" {
+		cfg.DKIMPrivateKey, err = base64.StdEncoding.DecodeString(dkimKeyEncoded)
+		if err != nil {
+			log.Fatal("DKIM private key has invalid base64")
+		}
+	}
 }
 
 func (cfg AppConfig) Denied(account string) bool {
@@ -118,6 +226,17 @@ type Server struct {
 	cfg       AppConfig
 	transport http.RoundTripper
 	db        stats.Database
+	mailer    Mailer
+	// key for signing links in emails
+	signingKey []byte
+	// signals job workers that a new job was queued
+	jobs chan struct{}
+	// signals the outbox worker that a new message was queued
+	outbox chan struct{}
+	// when each owner's org defaults were last synced
+	orgSyncs *orgSyncs
+	// tokens of recent Mailgun webhooks
+	webhookTokens *webhookTokens
 }
 
 // PushHandler tracks state for a single push handler
@@ -125,6 +244,8 @@ type PushHandler struct {
 	srv          Server
 	installation int64
 	repo         string
+	// force resends emails that were already sent
+	force bool
 }
 
 func openDenyAccounts(path string) map[string]bool {
@@ -154,12 +275,42 @@ func main() {
 	flag.StringVar(&cfg.Port, "port", cfg.Port, "port to listen on")
 	flag.StringVar(&logFilePath, "log", "-", "file to log to (- for stdout, otherwise file name within persist path)")
 	flag.BoolVar(&cfg.EmailStdout, "email-stdout", cfg.EmailStdout, "send emails to stdout")
+	flag.StringVar(&cfg.Mailer, "mailer", cfg.Mailer, "how to deliver email (smtp, mailgun-api, sendmail[:PATH], maildir:DIR, mbox:FILE, or stdout)")
+	flag.StringVar(&cfg.SmtpHost, "smtp-host", cfg.SmtpHost, "SMTP server host")
+	flag.StringVar(&cfg.SmtpPort, "smtp-port", cfg.SmtpPort, "SMTP server port")
+	flag.StringVar(&cfg.SmtpUser, "smtp-user", cfg.SmtpUser, "SMTP user name")
+	flag.StringVar(&cfg.SmtpTLS, "smtp-tls", cfg.SmtpTLS, "SMTP encryption (tls, starttls, or none)")
+	flag.BoolVar(&cfg.SmtpTLSInsecure, "smtp-tls-insecure", cfg.SmtpTLSInsecure, "do not verify the SMTP server's certificate")
+	flag.StringVar(&cfg.SmtpCAFile, "smtp-ca-file", cfg.SmtpCAFile, "PEM file of CA certificates for verifying the SMTP server")
+	flag.StringVar(&cfg.SmtpAuth, "smtp-auth", cfg.SmtpAuth, "SMTP authentication (plain, login, cram-md5, or none)")
+	flag.StringVar(&cfg.MailFromDomain, "mail-from-domain", cfg.MailFromDomain, "domain emails are sent from")
+	flag.StringVar(&cfg.EnvelopeFrom, "envelope-from", cfg.EnvelopeFrom, "SMTP envelope sender (defaults to the From address)")
+	flag.StringVar(&cfg.MailAPIURL, "mail-api-url", cfg.MailAPIURL, "base URL of the mail API for the mailgun-api mailer")
+	flag.StringVar(&cfg.MailAPIDomain, "mail-api-domain", cfg.MailAPIDomain, "sending domain for the mailgun-api mailer (defaults to the From domain)")
+	flag.StringVar(&cfg.DKIMSelector, "dkim-selector", cfg.DKIMSelector, "DKIM selector (enables DKIM signing)")
+	flag.StringVar(&cfg.DKIMDomain, "dkim-domain", cfg.DKIMDomain, "DKIM signing domain (defaults to the From domain)")
+	flag.StringVar(&cfg.DKIMHeaders, "dkim-headers", cfg.DKIMHeaders, "colon-separated headers to DKIM sign")
+	flag.IntVar(&cfg.RateLimitInstallation, "rate-limit-installation", cfg.RateLimitInstallation, "maximum emails per hour per installation (0 for no limit)")
+	flag.IntVar(&cfg.RateLimitRepo, "rate-limit-repo", cfg.RateLimitRepo, "maximum emails per hour per repository (0 for no limit)")
+	flag.IntVar(&cfg.RateLimitRecipient, "rate-limit-recipient", cfg.RateLimitRecipient, "maximum emails per hour per recipient (0 for no limit)")
+	flag.BoolVar(&cfg.RequireOptIn, "require-opt-in", cfg.RequireOptIn, "hold emails to each address until it confirms it wants them")
+	flag.BoolVar(&cfg.ConfigStatus, "config-status", cfg.ConfigStatus, "post a commit status when commit-emails.toml is invalid")
 	flag.Parse()
+	if cfg.EmailStdout {
+		cfg.Mailer = "stdout"
+	}
 
 	if err := os.MkdirAll(cfg.PersistPath, 0770); err != nil {
 		log.Fatal(err)
 	}
 
+	if flag.NArg() > 0 {
+		if err := runCommand(cfg, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	cfg.DenyAccounts = openDenyAccounts(filepath.Join(cfg.PersistPath, "deny-accounts.txt"))
 
 	var handler *slog.JSONHandler
@@ -205,11 +356,28 @@ func main() {
 	if err != nil {
 		log.Fatalf("could not open database: %v", err)
 	}
+	mailer, err := newMailer(cfg)
+	if err != nil {
+		log.Fatalf("could not create mailer: %v", err)
+	}
+	signingKey, err := loadSigningKey(cfg.PersistPath)
+	if err != nil {
+		log.Fatalf("could not load signing key: %v", err)
+	}
 	srv := Server{
-		cfg:       cfg,
-		transport: ct,
-		db:        db,
+		cfg:           cfg,
+		transport:     ct,
+		db:            db,
+		mailer:        mailer,
+		signingKey:    signingKey,
+		jobs:          make(chan struct{}, 1),
+		outbox:        make(chan struct{}, 1),
+		orgSyncs:      newOrgSyncs(),
+		webhookTokens: newWebhookTokens(),
 	}
+	srv.startJobWorkers()
+	srv.startOutbox()
+	go srv.runDigests()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Cache-Control", "max-age=600")
@@ -222,6 +390,27 @@ func main() {
 	mux.HandleFunc("/webhook", func(w http.ResponseWriter, req *http.Request) {
 		srv.githubEventHandler(w, req)
 	})
+	mux.HandleFunc("/confirm", func(w http.ResponseWriter, req *http.Request) {
+		srv.confirmHandler(w, req)
+	})
+	mux.HandleFunc("/unsubscribe", func(w http.ResponseWriter, req *http.Request) {
+		srv.unsubscribeHandler(w, req)
+	})
+	mux.HandleFunc("/mail-events", func(w http.ResponseWriter, req *http.Request) {
+		srv.mailEventsHandler(w, req)
+	})
+	mux.HandleFunc("/mail-events/mailgun", func(w http.ResponseWriter, req *http.Request) {
+		srv.mailEventsHandler(w, req)
+	})
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, req *http.Request) {
+		srv.validateHandler(w, req)
+	})
+	mux.HandleFunc(SCHEMA_PATH, func(w http.ResponseWriter, req *http.Request) {
+		srv.schemaHandler(w, req)
+	})
+	mux.HandleFunc("/admin/outbox", func(w http.ResponseWriter, req *http.Request) {
+		srv.adminOutboxHandler(w, req)
+	})
 
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf(":%s", cfg.Port),
@@ -256,7 +445,7 @@ func main() {
 		close(shutdownDone)
 	}()
 
-	if cfg.EmailStdout {
+	if cfg.Mailer == "stdout" {
 		fmt.Println("sending emails to stdout")
 	}
 	fmt.Printf("listening on %s:%s\n", cfg.Hostname, cfg.Port)
@@ -282,6 +471,7 @@ func (srv Server) githubEventHandler(w http.ResponseWriter, req *http.Request) {
 	event, err := github.ParseWebHook(github.WebHookType(req), payload)
 	if err != nil {
 		http.Error(w, "could not parse webhook: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 	switch event := event.(type) {
 	case *github.PingEvent:
@@ -297,30 +487,23 @@ func (srv Server) githubEventHandler(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "account denied", http.StatusForbidden)
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
-		repo := event.GetRepo().GetFullName()
-		err := PushHandler{
-			srv:          srv,
-			installation: event.GetInstallation().GetID(),
-			repo:         repo,
-		}.githubPushHandler(ctx, event)
+		// processing a push can take longer than GitHub is willing to wait, so
+		// persist it and respond immediately
+		deliveryId := github.DeliveryID(req)
+		if deliveryId == "" {
+			http.Error(w, "missing delivery id", http.StatusBadRequest)
+			return
+		}
+		err := srv.queueJob(deliveryId, github.WebHookType(req), payload)
 		if err != nil {
-			err = fmt.Errorf("push handler failed: %s", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			slog.Error("push handler",
+			slog.Error("could not queue push",
 				slog.String("error", err.Error()),
-				slog.String("repo", repo))
+				slog.String("repo", event.GetRepo().GetFullName()))
+			http.Error(w, "could not queue push", http.StatusInternalServerError)
 			return
 		}
-		srv.db.AddPush(event)
-		_, _ = w.Write([]byte("OK"))
-		before := (*event.Before)[:8]
-		after := (*event.After)[:8]
-		slog.Info("push success",
-			slog.String("repo", repo),
-			slog.String("ref change", fmt.Sprintf("%s: %s -> %s", event.GetRef(), before, after)),
-		)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("Accepted"))
 	case *github.InstallationEvent:
 		slog.Info("installation",
 			slog.String("action", event.GetAction()),
@@ -338,8 +521,13 @@ func (srv Server) githubEventHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 type EmailMsg struct {
-	// Recipient address(es) for header and envelope
+	// To header
 	To string
+	// Cc header (omitted if empty)
+	Cc string
+	// Envelope recipients, if not everyone in To and Cc (for example, to
+	// include Bcc recipients)
+	Rcpt []string
 	// Sender address for SMTP envelope
 	FromAddr string
 	// Formatted sender for header (e.g., "Name <email>")
@@ -351,36 +539,165 @@ type EmailMsg struct {
 	Subject string
 	// Date header
 	Date string
-
+	// Message-ID header, without angle brackets (omitted if empty)
+	MessageId string
+	// Message-ID this email replies to, for the In-Reply-To and References
+	// headers (omitted if empty)
+	InReplyTo string
+	// URL for the List-Unsubscribe header (omitted if empty)
+	ListUnsubscribe string
+
+	// Format of Body, "html" (the default) or "text"
+	Format string
 	// Email body
 	Body string
+	// Attachments make the message multipart/mixed
+	Attachments []Attachment
+	// Content-Type of a multipart body, with its boundary
+	multipartType string
+
+	// Commit the email is about, pushed to Branch (not part of the message)
+	Commit string
+	Branch string
+	// SummaryCommits are the commits a summary email is about (not part of
+	// the message)
+	SummaryCommits []stats.OutboxCommit
+	// Confirmation is set for a request to confirm the recipient's address,
+	// which is not held until they confirm (not part of the message)
+	Confirmation bool
+	// Patch is set for a patch email, whose body is kept as git am expects
+	// (not part of the message)
+	Patch bool
+	// NotBefore delays delivery until then, if set (not part of the message)
+	NotBefore time.Time
+	// Thread identifies a patch series, whose emails (numbered by
+	// ThreadIndex) reply to the cover letter at index 0
+	Thread      string
+	ThreadIndex int
+}
+
+// sentCommits returns the commits email is about, which are recorded as sent
+// to its recipients when it is delivered
+func (email EmailMsg) sentCommits() []stats.OutboxCommit {
+	if email.Commit == "" {
+		return email.SummaryCommits
+	}
+	return append([]stats.OutboxCommit{{Branch: email.Branch, SHA: email.Commit}}, email.SummaryCommits...)
+}
+
+// envelopeRecipients returns the addresses email is delivered to
+func (email EmailMsg) envelopeRecipients() []string {
+	if email.Rcpt != nil {
+		return email.Rcpt
+	}
+	return append(headerAddresses(email.To), headerAddresses(email.Cc)...)
 }
 
-func sendEmail(cfg AppConfig, email EmailMsg) error {
-	tmpl := template.Must(template.New("email").Parse(`
-Content-Type: text/html; charset=UTF-8
+func (email EmailMsg) ContentType() string {
+	if email.multipartType != "" {
+		return email.multipartType
+	}
+	if email.Format == "text" {
+		return "text/plain; charset=UTF-8"
+	}
+	return "text/html; charset=UTF-8"
+}
+
+// withAttachments returns email with its body and attachments combined into a
+// multipart body. Inline attachments go with an html body in a
+// multipart/related part, so it can refer to them.
+func (email EmailMsg) withAttachments() EmailMsg {
+	var inline, attached []Attachment
+	for _, a := range email.Attachments {
+		if a.ContentID != "" && email.Format != "text" {
+			inline = append(inline, a)
+		} else {
+			attached = append(attached, a)
+		}
+	}
+	contentType, body := email.ContentType(), email.Body
+	if len(inline) > 0 {
+		var boundary string
+		body, boundary = writeMultipart(contentType, body, inline)
+		contentType = fmt.Sprintf("multipart/related; boundary=%q; type=\"text/html\"", boundary)
+	}
+	if len(attached) > 0 {
+		var boundary string
+		body, boundary = writeMultipart(contentType, body, attached)
+		contentType = fmt.Sprintf("multipart/mixed; boundary=%q", boundary)
+	}
+	email.Body = body
+	email.multipartType = contentType
+	return email
+}
+
+// writeMultipart writes a multipart body with body (of type contentType)
+// followed by attachments, returning the body and its boundary
+func writeMultipart(contentType string, body string, attachments []Attachment) (string, string) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	part, _ := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	_, _ = io.WriteString(part, body)
+	for _, a := range attachments {
+		header := textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if a.ContentID != "" {
+			header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Name}))
+			header.Set("Content-ID", "<"+a.ContentID+">")
+		}
+		part, _ := w.CreatePart(header)
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			_, _ = io.WriteString(part, encoded[:76]+"\n")
+			encoded = encoded[76:]
+		}
+		_, _ = io.WriteString(part, encoded+"\n")
+	}
+	_ = w.Close()
+	// the rest of the message has Unix line endings
+	return strings.ReplaceAll(buf.String(), "\r\n", "\n"), w.Boundary()
+}
+
+var emailTemplate = template.Must(template.New("email").Parse(`MIME-Version: 1.0
+Content-Type: {{.ContentType}}
 From: {{.From}}
 To: {{.To}}
+{{- if .Cc}}
+Cc: {{.Cc}}
+{{- end}}
 Reply-To: {{.ReplyTo}}
 Subject: {{.Subject}}
 Date: {{.Date}}
+{{- if .MessageId}}
+Message-ID: <{{.MessageId}}>
+{{- end}}
+{{- if .InReplyTo}}
+In-Reply-To: <{{.InReplyTo}}>
+References: <{{.InReplyTo}}>
+{{- end}}
+{{- if .ListUnsubscribe}}
+List-Unsubscribe: <{{.ListUnsubscribe}}>
+List-Unsubscribe-Post: List-Unsubscribe=One-Click
+{{- end}}
 
 {{.Body}}
 `))
-	var emailText bytes.Buffer
-	tmpl.Execute(&emailText, email)
-
-	// TODO: implement MAX_LINES_PER_EMAIL
 
-	if cfg.EmailStdout {
-		fmt.Printf("%s", emailText.String())
-		return nil
+// renderEmail formats email as a message ready to send
+func renderEmail(email EmailMsg) []byte {
+	if len(email.Attachments) > 0 {
+		email = email.withAttachments()
 	}
-
-	auth := smtp.PlainAuth("", SMTP_USER, cfg.SmtpPassword, SMTP_HOST)
-	toSplit := strings.Split(email.To, ",")
-	err := smtp.SendMail(SMTP_ADDR, auth, email.FromAddr, toSplit, emailText.Bytes())
-	return err
+	var emailText bytes.Buffer
+	_ = emailTemplate.Execute(&emailText, email)
+	// TODO: implement MAX_LINES_PER_EMAIL
+	return emailText.Bytes()
 }
 
 func (h PushHandler) githubPushHandler(ctx context.Context, ev *github.PushEvent) error {
@@ -396,47 +713,158 @@ func (h PushHandler) githubPushHandler(ctx context.Context, ev *github.PushEvent
 		client = github.NewClient(nil)
 	}
 	gitDir, err := SyncRepo(ctx, client, ev.Repo, h.srv.cfg.PersistPath)
+	if err != nil {
+		return err
+	}
+	org := h.syncOrgDefaults(ctx, client, ev)
+	config, err := h.loadConfig(ctx, client, gitDir, org, ev)
 	if err != nil {
 		if _, ok := err.(MissingConfigError); ok {
 			slog.Info("push to unconfigured repo", slog.String("repo", h.repo))
 			return nil
 		}
-		return err
+		var cfgErr ConfigError
+		if errors.As(err, &cfgErr) {
+			// retrying won't help, and the repo has been notified
+			return nil
+		}
+		return fmt.Errorf("could not get config for %s: %w", h.repo, err)
 	}
-	var emails []EmailMsg
+	if config.Digest != "" {
+		h.recordDigestCommits(gitDir, config, ev)
+	} else if err := h.disableDigest(); err != nil {
+		slog.Warn("could not disable digest",
+			slog.String("repo", h.repo),
+			slog.String("error", err.Error()))
+	}
+	branch := strings.TrimPrefix(ev.GetRef(), "refs/heads/")
+	var commits []*github.HeadCommit
 	for _, commit := range ev.Commits {
-		if !commit.GetDistinct() {
-			continue
+		if config.includeCommit(commit) {
+			commits = append(commits, commit)
+		}
+	}
+	if len(commits) > MAX_EMAILS_PER_PUSH {
+		slog.Warn(fmt.Sprintf("push has %d commits, taking only %d",
+			len(commits),
+			MAX_EMAILS_PER_PUSH),
+			slog.String("repo", ev.GetRepo().GetFullName()))
+		if config.Email.Style == "patch" {
+			// keep the start of the series, so the patches still apply
+			commits = commits[:MAX_EMAILS_PER_PUSH]
+		} else {
+			commits = commits[len(commits)-MAX_EMAILS_PER_PUSH:]
 		}
-		ref := ev.GetRef()
-		branch := strings.TrimPrefix(ref, "refs/heads/")
-		email, err := commitToEmail(gitDir, ev.GetRepo().GetName(), branch, commit)
+	}
+	var emails []EmailMsg
+	if config.Email.Style == "patch" {
+		unsent := func(commit string, addr string) bool {
+			return !h.wasSent(config.dedupeBranch(branch), commit, normalizeAddress(addr))
+		}
+		emails, err = patchSeriesEmails(h.srv.cfg, config, gitDir, ev.GetRepo().GetName(), branch, commits, unsent)
 		if err != nil {
-			slog.Warn("could not generate email",
+			slog.Warn("could not generate patch emails",
 				slog.String("repo", ev.GetRepo().GetFullName()),
-				slog.String("commit", commit.GetID()),
 				slog.String("error", err.Error()))
+		}
+	} else {
+		for _, commit := range commits {
+			commitEmails, err := commitToEmails(h.srv.cfg, config, gitDir, ev.GetRepo().GetName(), branch, commit)
+			if err != nil {
+				slog.Warn("could not generate email",
+					slog.String("repo", ev.GetRepo().GetFullName()),
+					slog.String("commit", commit.GetID()),
+					slog.String("error", err.Error()))
+				continue
+			}
+			emails = append(emails, commitEmails...)
+		}
+	}
+	var queued []EmailMsg
+	for _, email := range emails {
+		if email.Commit == "" {
+			// a cover letter, which goes to the recipients of its patches
+			queued = append(queued, email)
+			continue
+		}
+		to := h.unsentRecipients(email, config.dedupeBranch(branch))
+		to = h.srv.unsuppressedRecipients(h.repo, to)
+		if len(to) == 0 {
+			slog.Info("email already sent",
+				slog.String("repo", h.repo),
+				slog.String("commit", email.Commit))
 			continue
 		}
-		emails = append(emails, *email)
+		email.Rcpt = to
+		queued = append(queued, email)
 	}
-	if len(emails) > MAX_EMAILS_PER_PUSH {
-		emails = emails[len(emails)-MAX_EMAILS_PER_PUSH:]
-		slog.Warn(fmt.Sprintf("push generated %d emails, taking only %d",
-			len(emails),
-			MAX_EMAILS_PER_PUSH),
-			slog.String("repo", ev.GetRepo().GetFullName()))
+	queued = coverRecipients(queued)
+	if len(queued) == 0 {
+		return nil
 	}
-	for _, email := range emails {
-		err := sendEmail(h.srv.cfg, email)
-		if err != nil {
-			slog.Warn("could not send email",
-				slog.String("repo", ev.GetRepo().GetFullName()),
-				slog.String("to", email.To),
-				slog.String("from", email.From),
-				slog.String("reply-to", email.ReplyTo),
-				slog.Any("string", err.Error()))
+	quietStart, quietEnd, quiet := config.QuietHours.window(time.Now())
+	if quiet {
+		slog.Info("holding emails for quiet hours",
+			slog.String("repo", h.repo),
+			slog.Time("until", quietEnd))
+	}
+	if quiet && config.QuietHours.Summary {
+		if err := h.holdForSummary(gitDir, ev, queued, quietStart, quietEnd); err != nil {
+			return fmt.Errorf("could not hold emails: %w", err)
+		}
+	} else {
+		if quiet {
+			for i := range queued {
+				queued[i].NotBefore = quietEnd
+			}
 		}
+		// queue all the emails at once, so they are delivered over one connection
+		if err := h.srv.queueEmails(h.installation, h.repo, queued); err != nil {
+			return fmt.Errorf("could not queue emails: %w", err)
+		}
+	}
+	return nil
+}
+
+// splitRecipients splits a comma-separated list of addresses
+func splitRecipients(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// unsentRecipients filters the recipients of email to those who have not
+// already received an email for the same commit (on branch, or on any branch if
+// branch is empty). This avoids duplicates from redelivered webhooks and from
+// the same commit being pushed to several branches, unless the push is being
+// forcibly resent.
+func (h PushHandler) unsentRecipients(email EmailMsg, branch string) []string {
+	var to []string
+	for _, addr := range email.envelopeRecipients() {
+		if !h.wasSent(branch, email.Commit, normalizeAddress(addr)) {
+			to = append(to, addr)
+		}
+	}
+	return to
+}
+
+// wasSent reports whether addr has already been sent an email for commit (on
+// branch, or on any branch if branch is empty), or one is on its way, and
+// should not get another
+func (h PushHandler) wasSent(branch string, commit string, addr string) bool {
+	if h.force {
+		return false
+	}
+	sent, err := h.srv.db.WasSent(h.repo, branch, commit, addr)
+	if err != nil {
+		slog.Warn("could not check sent emails",
+			slog.String("repo", h.repo),
+			slog.String("error", err.Error()))
 	}
-	return err
+	return sent
 }
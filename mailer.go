@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mailer delivers rendered messages.
+type Mailer interface {
+	// Send delivers msg from the envelope sender from to the envelope
+	// recipients to.
+	Send(from string, to []string, msg []byte) error
+}
+
+// OutgoingMsg is a rendered message with its envelope.
+type OutgoingMsg struct {
+	From string
+	To   []string
+	Msg  []byte
+}
+
+// BatchMailer is implemented by mailers that can deliver several messages more
+// efficiently than one at a time.
+type BatchMailer interface {
+	Mailer
+	// SendBatch delivers msgs and returns an error (or nil) for each one.
+	SendBatch(msgs []OutgoingMsg) []error
+}
+
+// sendBatch delivers msgs with m, using a single batch if m supports it.
+func sendBatch(m Mailer, msgs []OutgoingMsg) []error {
+	if bm, ok := m.(BatchMailer); ok {
+		return bm.SendBatch(msgs)
+	}
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = m.Send(msg.From, msg.To, msg.Msg)
+	}
+	return errs
+}
+
+// newMailer creates the Mailer selected by cfg.Mailer, signing messages with
+// DKIM if configured. The mailer is one of:
+//
+//   - smtp: send through the configured SMTP server (the default)
+//   - mailgun-api: send with Mailgun's HTTP API
+//   - sendmail[:PATH]: pipe to a local sendmail binary
+//   - maildir:DIR: write each message to a file in a Maildir
+//   - mbox:FILE: append messages to an mbox file
+//   - stdout: print messages
+func newMailer(cfg AppConfig) (Mailer, error) {
+	m, err := newBaseMailer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := loadDKIMSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		return dkimMailer{Mailer: m, signer: signer}, nil
+	}
+	return m, nil
+}
+
+func newBaseMailer(cfg AppConfig) (Mailer, error) {
+	kind, arg, _ := strings.Cut(cfg.Mailer, ":")
+	switch kind {
+	case "", "smtp":
+		return newSMTPMailer(cfg)
+	case "mailgun-api":
+		return newMailgunAPIMailer(cfg)
+	case "sendmail":
+		if arg == "" {
+			arg = "/usr/sbin/sendmail"
+		}
+		return &sendmailMailer{path: arg}, nil
+	case "maildir":
+		if arg == "" {
+			return nil, fmt.Errorf("maildir mailer needs a directory (maildir:DIR)")
+		}
+		return newMaildirMailer(arg)
+	case "mbox":
+		if arg == "" {
+			return nil, fmt.Errorf("mbox mailer needs a file (mbox:FILE)")
+		}
+		return &mboxMailer{path: arg}, nil
+	case "stdout":
+		return stdoutMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %s", cfg.Mailer)
+}
+
+// sendmailMailer pipes messages to a sendmail-compatible program (sendmail,
+// postfix, msmtp, ...).
+type sendmailMailer struct {
+	path string
+}
+
+func (m *sendmailMailer) Send(from string, to []string, msg []byte) error {
+	// Recipients are passed explicitly rather than with -t (which reads them
+	// from the headers), since the envelope does not always match the To
+	// header.
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(m.path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sendmail failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// maildirMailer delivers each message as a file in a Maildir
+// (https://cr.yp.to/proto/maildir.html).
+type maildirMailer struct {
+	dir      string
+	hostname string
+	count    atomic.Int64
+}
+
+func newMaildirMailer(dir string) (*maildirMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0770); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// these characters are not allowed in maildir file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &maildirMailer{dir: dir, hostname: hostname}, nil
+}
+
+func (m *maildirMailer) Send(from string, to []string, msg []byte) error {
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), m.count.Add(1), m.hostname)
+	tmpPath := filepath.Join(m.dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, msg, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(m.dir, "new", name))
+}
+
+// mboxMailer appends messages to a file in mboxrd format.
+type mboxMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (m *mboxMailer) Send(from string, to []string, msg []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	for _, line := range strings.SplitAfter(string(msg), "\n") {
+		// mboxrd quoting: add a > to lines that look like (quoted) From_ lines
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+	}
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type stdoutMailer struct{}
+
+func (stdoutMailer) Send(from string, to []string, msg []byte) error {
+	fmt.Printf("%s", msg)
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+const MAX_SEND_ATTEMPTS = 8
+
+const NUM_OUTBOX_WORKERS = 2
+
+// maximum number of messages delivered over one connection
+const OUTBOX_BATCH_SIZE = MAX_EMAILS_PER_PUSH
+
+// how often the outbox worker checks for messages whose retry time has arrived
+const OUTBOX_POLL_INTERVAL = 15 * time.Second
+
+// how long delivered messages are kept in the outbox
+const OUTBOX_RETENTION = 7 * 24 * time.Hour
+
+// sendBackoff is the delay before retrying a message that has failed attempts
+// times: 1m, 2m, 4m, ... (about 2 hours in total)
+func sendBackoff(attempts int) time.Duration {
+	return time.Minute << (attempts - 1)
+}
+
+// isPermanentSendError classifies a delivery error. SMTP 5xx replies and mail
+// API client errors are permanent; everything else (4xx replies, throttling,
+// server and network errors) is worth retrying.
+func isPermanentSendError(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 500
+	}
+	var apiErr *mailAPIError
+	if errors.As(err, &apiErr) {
+		return !apiErr.Temporary()
+	}
+	return false
+}
+
+// queueEmails renders emails and adds them to the outbox for delivery. Each
+// recipient gets their own copy, with a link to unsubscribe from repo. The
+// emails are delivered together if possible. Copies for recipients who have
+// not confirmed their address are held until they do.
+func (srv Server) queueEmails(installation int64, repo string, emails []EmailMsg) error {
+	if err := srv.db.AddOutbox(srv.outboxMessages(installation, repo, emails)); err != nil {
+		return err
+	}
+	srv.notifyOutbox()
+	return nil
+}
+
+// outboxMessages renders emails into outbox messages, as for queueEmails
+func (srv Server) outboxMessages(installation int64, repo string, emails []EmailMsg) []stats.OutboxMsg {
+	var msgs []stats.OutboxMsg
+	for _, email := range emails {
+		to, held := email.envelopeRecipients(), []string(nil)
+		if !email.Confirmation {
+			to, held = srv.holdUnconfirmed(installation, repo, to)
+		}
+		for i, addr := range append(to, held...) {
+			status := "pending"
+			if i >= len(to) {
+				status = "held"
+			}
+			addr = normalizeAddress(addr)
+			recipientEmail := srv.withUnsubscribe(email, repo, addr)
+			recipientEmail.MessageId = srv.cfg.newMessageId()
+			if email.Thread != "" {
+				recipientEmail.MessageId = srv.cfg.threadMessageId(email.Thread, email.ThreadIndex, addr)
+				if email.ThreadIndex > 0 {
+					recipientEmail.InReplyTo = srv.cfg.threadMessageId(email.Thread, 0, addr)
+				}
+			}
+			msgs = append(msgs, stats.OutboxMsg{
+				Installation: installation,
+				Repo:         repo,
+				FromAddr:     email.FromAddr,
+				Recipients:   addr,
+				Message:      renderEmail(recipientEmail),
+				MessageId:    recipientEmail.MessageId,
+				Status:       status,
+				NextAttempt:  email.NotBefore,
+				Commits:      email.sentCommits(),
+			})
+		}
+	}
+	return msgs
+}
+
+// newMessageId generates a unique Message-ID, which identifies the message in
+// bounces and complaints
+func (cfg AppConfig) newMessageId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b) + "@" + cfg.MailFromDomain
+}
+
+// queueEmail adds a single email to the outbox.
+func (srv Server) queueEmail(installation int64, repo string, email EmailMsg) error {
+	return srv.queueEmails(installation, repo, []EmailMsg{email})
+}
+
+func (srv Server) notifyOutbox() {
+	select {
+	case srv.outbox <- struct{}{}:
+	default:
+	}
+}
+
+// startOutbox starts the workers that deliver messages from the outbox.
+// Deliveries interrupted by a previous shutdown are retried.
+func (srv Server) startOutbox() {
+	if err := srv.db.ResetSendingOutbox(); err != nil {
+		slog.Error("could not reset outbox", slog.String("error", err.Error()))
+	}
+	for i := 0; i < NUM_OUTBOX_WORKERS; i++ {
+		go srv.outboxWorker()
+	}
+	go func() {
+		for {
+			now := time.Now()
+			if err := srv.db.PruneOutbox(now.Add(-OUTBOX_RETENTION), now.Add(-HELD_RETENTION)); err != nil {
+				slog.Warn("could not prune outbox", slog.String("error", err.Error()))
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+	srv.notifyOutbox()
+}
+
+// outboxWorker delivers messages in batches, retrying transient failures.
+func (srv Server) outboxWorker() {
+	ticker := time.NewTicker(OUTBOX_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		msgs, err := srv.db.ClaimOutbox(time.Now(), OUTBOX_BATCH_SIZE)
+		if err != nil {
+			slog.Error("could not claim outbox messages", slog.String("error", err.Error()))
+		}
+		if len(msgs) > 0 {
+			srv.deliverOutbox(msgs)
+			// there may be more messages queued behind this batch
+			srv.notifyOutbox()
+			continue
+		}
+		select {
+		case <-srv.outbox:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv Server) deliverOutbox(claimed []stats.OutboxMsg) {
+	var msgs []stats.OutboxMsg
+	var outgoing []OutgoingMsg
+	for _, msg := range claimed {
+		if srv.rateLimited(msg) {
+			continue
+		}
+		msgs = append(msgs, msg)
+		outgoing = append(outgoing, OutgoingMsg{
+			From: msg.FromAddr,
+			To:   splitRecipients(msg.Recipients),
+			Msg:  msg.Message,
+		})
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	errs := sendBatch(srv.mailer, outgoing)
+	for i, msg := range msgs {
+		srv.finishDelivery(msg, errs[i])
+	}
+}
+
+// finishDelivery updates the outbox with the result of a delivery attempt
+func (srv Server) finishDelivery(msg stats.OutboxMsg, err error) {
+	if err == nil {
+		err = srv.db.FinishOutbox(msg.Id, "sent", nil)
+	} else if isPermanentSendError(err) || msg.Attempts >= MAX_SEND_ATTEMPTS {
+		slog.Error("email delivery failed",
+			slog.String("repo", msg.Repo),
+			slog.Int64("id", msg.Id),
+			slog.String("to", msg.Recipients),
+			slog.Int("attempts", msg.Attempts),
+			slog.String("error", err.Error()))
+		err = srv.db.FinishOutbox(msg.Id, "dead", err)
+	} else {
+		delay := sendBackoff(msg.Attempts)
+		slog.Warn("email delivery will be retried",
+			slog.String("repo", msg.Repo),
+			slog.Int64("id", msg.Id),
+			slog.String("to", msg.Recipients),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()))
+		err = srv.db.RetryOutbox(msg.Id, time.Now().Add(delay), err)
+	}
+	if err != nil {
+		slog.Error("could not update outbox", slog.String("error", err.Error()))
+	}
+}
+
+// outboxEntry is the JSON representation of an outbox message, without the
+// message itself
+type outboxEntry struct {
+	Id          int64     `json:"id"`
+	Repo        string    `json:"repo"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Subject     string    `json:"subject"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+func newOutboxEntry(msg stats.OutboxMsg) outboxEntry {
+	return outboxEntry{
+		Id:          msg.Id,
+		Repo:        msg.Repo,
+		From:        msg.FromAddr,
+		To:          msg.Recipients,
+		Subject:     messageSubject(msg.Message),
+		Status:      msg.Status,
+		Attempts:    msg.Attempts,
+		NextAttempt: msg.NextAttempt,
+		LastError:   msg.LastError,
+		Created:     msg.CreatedAt,
+	}
+}
+
+// messageSubject extracts the Subject header from a rendered message
+func messageSubject(msg []byte) string {
+	headers, _, _ := strings.Cut(string(msg), "\n\n")
+	for _, line := range strings.Split(headers, "\n") {
+		if subject, ok := strings.CutPrefix(line, "Subject: "); ok {
+			return strings.TrimSpace(subject)
+		}
+	}
+	return ""
+}
+
+// authorizeAdmin checks the bearer token on an admin request. Admin endpoints
+// are disabled if no token is configured.
+func (srv Server) authorizeAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if srv.cfg.AdminToken == "" {
+		http.NotFound(w, req)
+		return false
+	}
+	token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(srv.cfg.AdminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminOutboxHandler lists outbox messages (GET /admin/outbox?status=dead) and
+// requeues them (POST /admin/outbox?requeue=ID).
+func (srv Server) adminOutboxHandler(w http.ResponseWriter, req *http.Request) {
+	if !srv.authorizeAdmin(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		msgs, err := srv.db.ListOutbox(req.URL.Query().Get("status"), 100)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries := []outboxEntry{}
+		for _, msg := range msgs {
+			entries = append(entries, newOutboxEntry(msg))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(entries)
+	case http.MethodPost:
+		id, err := strconv.ParseInt(req.URL.Query().Get("requeue"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid message id", http.StatusBadRequest)
+			return
+		}
+		found, err := srv.db.RequeueOutbox(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("no message %d", id), http.StatusNotFound)
+			return
+		}
+		srv.notifyOutbox()
+		_, _ = w.Write([]byte("OK"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
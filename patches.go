@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v75/github"
+)
+
+// git's empty tree, for diffs of root commits
+const EMPTY_TREE = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+	// ContentID makes the attachment an inline part of an html body, which
+	// refers to it as cid:<ContentID>
+	ContentID string
+}
+
+// formatPatch returns a commit as a patch in mbox format, as written by git
+// format-patch
+func formatPatch(gitDir string, commitId string) ([]byte, error) {
+	return runGitCmd(gitDir, nil, "format-patch", "-1", "--stdout", commitId)
+}
+
+// patchAttachment attaches commit as a .patch file named like git format-patch
+// would name it.
+func patchAttachment(gitDir string, commitId string) (Attachment, error) {
+	patch, err := formatPatch(gitDir, commitId)
+	if err != nil {
+		return Attachment{}, err
+	}
+	name, err := runGitCmd(gitDir, nil, "log", "-1", "--format=%f", commitId)
+	if err != nil {
+		return Attachment{}, err
+	}
+	return Attachment{
+		Name:        fmt.Sprintf("0001-%s.patch", strings.TrimSpace(string(name))),
+		ContentType: "text/x-patch; charset=UTF-8",
+		Data:        patch,
+	}, nil
+}
+
+// parsedPatch is the output of git format-patch, split up to be sent as in git
+// send-email
+type parsedPatch struct {
+	// Author is the From header of the patch
+	Author  string
+	Subject string
+	// Body is the rest of the commit message, the diffstat, and the diff
+	Body string
+}
+
+func parsePatch(patch []byte) (parsedPatch, error) {
+	r := bufio.NewReader(bytes.NewReader(patch))
+	// skip the mbox "From <sha> <date>" line
+	if _, err := r.ReadString('\n'); err != nil {
+		return parsedPatch{}, fmt.Errorf("empty patch")
+	}
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return parsedPatch{}, err
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return parsedPatch{}, err
+	}
+	dec := new(mime.WordDecoder)
+	author, err := dec.DecodeHeader(msg.Header.Get("From"))
+	if err != nil {
+		author = msg.Header.Get("From")
+	}
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	// format-patch folds long subjects
+	subject = strings.Join(strings.Fields(subject), " ")
+	subject = strings.TrimPrefix(subject, "[PATCH] ")
+	return parsedPatch{Author: author, Subject: subject, Body: string(body)}, nil
+}
+
+// newThreadId identifies the emails of a patch series
+func newThreadId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// threadMessageId is the Message-ID of the email at index in a patch series,
+// for one recipient. Each recipient gets their own copy of the series, so the
+// ids depend on the recipient.
+func (cfg AppConfig) threadMessageId(thread string, index int, recipient string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s", thread, index, recipient)))
+	return hex.EncodeToString(h[:16]) + "@" + cfg.MailFromDomain
+}
+
+// patchSeriesEmails creates emails for commits in the format of git
+// send-email: a [PATCH n/m] email per commit and a [PATCH 0/m] cover letter
+// if there are several, which the patches reply to. Each group of recipients
+// (including code owners of any of the commits) gets the series of commits
+// that have not been sent to them, according to unsent, numbered and
+// summarized in its cover letter without the commits they already have.
+func patchSeriesEmails(cfg AppConfig, config CommitEmailConfig, gitDir string, repo string, branch string, commits []*github.HeadCommit, unsent func(commit string, addr string) bool) ([]EmailMsg, error) {
+	if len(commits) == 0 {
+		return nil, nil
+	}
+	groups := config.CommitGroups()
+	var recipients []string
+	for _, group := range groups {
+		recipients = append(recipients, group.Envelope()...)
+	}
+	owners := RecipientGroup{Name: "codeowners"}
+	for _, commit := range commits {
+		g := config.codeownersGroup(gitDir, repo, commit.GetID(), recipients)
+		owners.To = append(owners.To, g.To...)
+		recipients = append(recipients, g.Envelope()...)
+	}
+	if !owners.Empty() {
+		groups = append(groups, owners)
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	var patches []EmailMsg
+	for _, commit := range commits {
+		patch, err := formatPatch(gitDir, commit.GetID())
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parsePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse patch for %s: %w", commit.GetID(), err)
+		}
+		email := commitToEmail(cfg, repo, branch, commit)
+		email.Subject = parsed.Subject
+		// the email is not from the author, so as in git send-email the
+		// author goes in the body for git am
+		email.Body = fmt.Sprintf("From: %s\n\n%s", parsed.Author, parsed.Body)
+		email.Patch = true
+		patches = append(patches, email)
+	}
+
+	var emails []EmailMsg
+	for _, group := range groups {
+		// recipients who are missing the same commits get a series of those
+		var keys []string
+		rcpt := make(map[string][]string)
+		for _, addr := range group.Envelope() {
+			var key strings.Builder
+			for i, commit := range commits {
+				if unsent(commit.GetID(), addr) {
+					fmt.Fprintf(&key, "%d,", i)
+				}
+			}
+			if key.Len() == 0 {
+				continue
+			}
+			if _, ok := rcpt[key.String()]; !ok {
+				keys = append(keys, key.String())
+			}
+			rcpt[key.String()] = append(rcpt[key.String()], addr)
+		}
+		for _, key := range keys {
+			var seriesCommits []*github.HeadCommit
+			var series []EmailMsg
+			for _, i := range strings.Split(strings.TrimSuffix(key, ","), ",") {
+				i, _ := strconv.Atoi(i)
+				seriesCommits = append(seriesCommits, commits[i])
+				series = append(series, patches[i])
+			}
+			total := len(series)
+			thread := ""
+			if total > 1 {
+				// each group gets its own thread
+				thread = newThreadId()
+				cover, err := coverLetter(cfg, gitDir, repo, branch, seriesCommits)
+				if err != nil {
+					return nil, err
+				}
+				series = append([]EmailMsg{cover}, series...)
+			}
+			for i, email := range series {
+				if email.Commit != "" {
+					if total > 1 {
+						email.Subject = fmt.Sprintf("[PATCH %d/%d] %s", i, total, email.Subject)
+						email.ThreadIndex = i
+					} else {
+						email.Subject = "[PATCH] " + email.Subject
+					}
+				}
+				email.To = formatAddresses(group.To.addresses())
+				email.Cc = formatAddresses(group.Cc.addresses())
+				email.Rcpt = rcpt[key]
+				email.Format = "text"
+				email.Thread = thread
+				emails = append(emails, email)
+			}
+		}
+	}
+	return emails, nil
+}
+
+// coverLetter summarizes a patch series, like git format-patch
+// --cover-letter: the commits by author, and the combined diffstat.
+func coverLetter(cfg AppConfig, gitDir string, repo string, branch string, commits []*github.HeadCommit) (EmailMsg, error) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "%d commits pushed to %s %s\n\n", len(commits), repo, branch)
+	var authors []string
+	byAuthor := make(map[string][]string)
+	for _, commit := range commits {
+		author := commit.GetAuthor().GetName()
+		if _, ok := byAuthor[author]; !ok {
+			authors = append(authors, author)
+		}
+		subject, _, _ := strings.Cut(commit.GetMessage(), "\n")
+		byAuthor[author] = append(byAuthor[author], subject)
+	}
+	for _, author := range authors {
+		fmt.Fprintf(&body, "%s (%d):\n", author, len(byAuthor[author]))
+		for _, subject := range byAuthor[author] {
+			fmt.Fprintf(&body, "  %s\n", subject)
+		}
+		body.WriteString("\n")
+	}
+	first, last := commits[0].GetID(), commits[len(commits)-1].GetID()
+	base, err := GitObjectId(gitDir, first+"^")
+	if err != nil {
+		base = EMPTY_TREE
+	}
+	stat, err := runGitCmd(gitDir, nil, "diff", "--stat", base, last)
+	if err != nil {
+		return EmailMsg{}, err
+	}
+	body.Write(stat)
+
+	email := commitToEmail(cfg, repo, branch, commits[len(commits)-1])
+	email.From = fmt.Sprintf("commit-email-bot <%s>", cfg.NotifyEmail())
+	email.ReplyTo = cfg.NotifyEmail()
+	email.Subject = fmt.Sprintf("[PATCH 0/%d] %s %s", len(commits), repo, branch)
+	email.Body = body.String()
+	// the cover letter is sent to the recipients of the patches
+	email.Commit = ""
+	return email, nil
+}
+
+// coverRecipients sends the cover letter of each patch series to everyone who
+// is sent any of its patches, and drops cover letters of series where no
+// patches are left.
+func coverRecipients(emails []EmailMsg) []EmailMsg {
+	rcpt := make(map[string][]string)
+	seen := make(map[string]map[string]bool)
+	for _, email := range emails {
+		if email.Thread == "" || email.ThreadIndex == 0 {
+			continue
+		}
+		if seen[email.Thread] == nil {
+			seen[email.Thread] = make(map[string]bool)
+		}
+		for _, addr := range email.Rcpt {
+			if !seen[email.Thread][normalizeAddress(addr)] {
+				seen[email.Thread][normalizeAddress(addr)] = true
+				rcpt[email.Thread] = append(rcpt[email.Thread], addr)
+			}
+		}
+	}
+	var kept []EmailMsg
+	for _, email := range emails {
+		if email.Thread != "" && email.ThreadIndex == 0 {
+			email.Rcpt = rcpt[email.Thread]
+			if len(email.Rcpt) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, email)
+	}
+	return kept
+}
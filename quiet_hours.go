@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	// the container has no time zone database
+	_ "time/tzdata"
+
+	"github.com/google/go-github/v75/github"
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// QuietHours is a daily window during which commit emails are held, written
+// as quiet_hours = { start = "22:00", end = "07:00", tz = "Europe/Berlin" }.
+type QuietHours struct {
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+	// TZ is an IANA time zone name (default UTC)
+	TZ string `toml:"tz"`
+	// Summary collapses the held emails into one summary per recipient
+	Summary bool `toml:"summary"`
+}
+
+func (q QuietHours) Enabled() bool {
+	return q.Start != "" || q.End != ""
+}
+
+func parseTimeOfDay(s string) (hour, min int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q (should be HH:MM)", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func (q QuietHours) validate() error {
+	if !q.Enabled() {
+		return nil
+	}
+	if _, _, err := parseTimeOfDay(q.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if _, _, err := parseTimeOfDay(q.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	if q.Start == q.End {
+		return fmt.Errorf("start and end are the same")
+	}
+	if _, err := time.LoadLocation(q.TZ); err != nil {
+		return fmt.Errorf("unknown tz %s", q.TZ)
+	}
+	return nil
+}
+
+// window returns the quiet hours containing t, if t is in quiet hours. The
+// window can span midnight (22:00 to 07:00).
+func (q QuietHours) window(t time.Time) (start time.Time, end time.Time, quiet bool) {
+	if !q.Enabled() {
+		return
+	}
+	loc, err := time.LoadLocation(q.TZ)
+	if err != nil {
+		return
+	}
+	startHour, startMin, _ := parseTimeOfDay(q.Start)
+	endHour, endMin, _ := parseTimeOfDay(q.End)
+	t = t.In(loc)
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+day, hour, min, 0, 0, loc)
+	}
+	startToday, endToday := at(0, startHour, startMin), at(0, endHour, endMin)
+	if startToday.Before(endToday) {
+		return startToday, endToday, !t.Before(startToday) && t.Before(endToday)
+	}
+	// the window spans midnight
+	if !t.Before(startToday) {
+		return startToday, at(1, endHour, endMin), true
+	}
+	if t.Before(endToday) {
+		return at(-1, startHour, startMin), endToday, true
+	}
+	return
+}
+
+// holdForSummary records the commits of emails to be summarized for each of
+// their recipients at the end of quiet hours.
+func (h PushHandler) holdForSummary(gitDir string, ev *github.PushEvent, emails []EmailMsg, since time.Time, until time.Time) error {
+	commits := make(map[string]*github.HeadCommit)
+	for _, commit := range ev.Commits {
+		commits[commit.GetID()] = commit
+	}
+	branch := strings.TrimPrefix(ev.GetRef(), "refs/heads/")
+	shortstats := make(map[string]string)
+	var held []stats.QuietCommit
+	for _, email := range emails {
+		commit := commits[email.Commit]
+		if commit == nil {
+			continue
+		}
+		shortstat, ok := shortstats[email.Commit]
+		if !ok {
+			var err error
+			shortstat, err = GitShortStat(gitDir, email.Commit)
+			if err != nil {
+				slog.Warn("could not get shortstat",
+					slog.String("repo", h.repo),
+					slog.String("commit", email.Commit),
+					slog.String("error", err.Error()))
+			}
+			shortstats[email.Commit] = shortstat
+		}
+		subject, _, _ := strings.Cut(commit.GetMessage(), "\n")
+		for _, addr := range email.Rcpt {
+			held = append(held, stats.QuietCommit{
+				DigestCommit: stats.DigestCommit{
+					Repo:      h.repo,
+					Branch:    branch,
+					SHA:       commit.GetID(),
+					Subject:   subject,
+					Author:    commit.GetAuthor().GetName(),
+					URL:       commit.GetURL(),
+					ShortStat: shortstat,
+				},
+				Recipient:    normalizeAddress(addr),
+				Installation: h.installation,
+				Format:       email.Format,
+				Since:        since,
+				ReleaseAt:    until,
+			})
+		}
+	}
+	return h.srv.db.AddQuietCommits(held)
+}
+
+// sendQuietSummaries queues a summary for each recipient whose quiet hours
+// ended, of the commits held for them.
+func (srv Server) sendQuietSummaries(now time.Time) error {
+	commits, err := srv.db.DueQuietCommits(now)
+	if err != nil {
+		return err
+	}
+	for len(commits) > 0 {
+		// commits are sorted by repo and recipient
+		n := 1
+		for n < len(commits) && commits[n].Repo == commits[0].Repo && commits[n].Recipient == commits[0].Recipient {
+			n++
+		}
+		batch := commits[:n]
+		commits = commits[n:]
+		if err := srv.sendQuietSummary(batch, now); err != nil {
+			slog.Warn("could not send quiet hours summary",
+				slog.String("repo", batch[0].Repo),
+				slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (srv Server) sendQuietSummary(held []stats.QuietCommit, now time.Time) error {
+	repo := stats.DigestRepo{
+		Repo:       held[0].Repo,
+		Period:     "quiet hours",
+		Recipients: held[0].Recipient,
+		LastSent:   held[0].Since,
+	}
+	var commits []stats.DigestCommit
+	var summarized []stats.OutboxCommit
+	var ids []int64
+	var installation int64
+	for _, c := range held {
+		if c.Installation != 0 {
+			installation = c.Installation
+		}
+		// the summary is in the format of the recipient's latest emails
+		repo.Format = c.Format
+		commits = append(commits, c.DigestCommit)
+		summarized = append(summarized, stats.OutboxCommit{Branch: c.Branch, SHA: c.SHA})
+		ids = append(ids, c.Id)
+		if c.Since.Before(repo.LastSent) {
+			repo.LastSent = c.Since
+		}
+	}
+	email, err := digestToEmail(srv.cfg, repo, commits, now)
+	if err != nil {
+		return err
+	}
+	email.SummaryCommits = summarized
+	email.Rcpt = srv.unsuppressedRecipients(repo.Repo, email.Rcpt)
+	var msgs []stats.OutboxMsg
+	if len(email.Rcpt) > 0 {
+		msgs = srv.outboxMessages(installation, repo.Repo, []EmailMsg{*email})
+	}
+	// queued and released together, so a crash can't send it twice
+	if err := srv.db.QueueQuietSummary(msgs, ids); err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		srv.notifyOutbox()
+		slog.Info("quiet hours summary queued",
+			slog.String("repo", repo.Repo),
+			slog.String("to", repo.Recipients),
+			slog.Int("commits", len(commits)))
+	}
+	return nil
+}
+
+// quietUntil returns when the current quiet hours of repo end, or the zero time
+// if it is not in quiet hours, reading its config from the default branch.
+func (srv Server) quietUntil(repo string, now time.Time) time.Time {
+	owner, _, _ := strings.Cut(repo, "/")
+	org := loadOrgDefaults(srv.cfg.PersistPath, owner)
+	config, err := getConfig(repoGitDir(srv.cfg.PersistPath, repo), "HEAD", org)
+	if err != nil {
+		return time.Time{}
+	}
+	_, end, quiet := config.QuietHours.window(now)
+	if !quiet {
+		return time.Time{}
+	}
+	return end
+}
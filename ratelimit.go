@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// hourlyLimit is a token bucket allowing perHour emails per hour, in bursts of
+// up to perHour
+func hourlyLimit(key string, perHour int) stats.RateLimit {
+	return stats.RateLimit{
+		Key:   key,
+		Burst: float64(perHour),
+		Rate:  float64(perHour) / 3600,
+	}
+}
+
+// sendLimits returns the rate limits that apply to delivering msg. A limit of 0
+// is disabled.
+func (cfg AppConfig) sendLimits(msg stats.OutboxMsg) []stats.RateLimit {
+	var limits []stats.RateLimit
+	if cfg.RateLimitInstallation > 0 && msg.Installation != 0 {
+		limits = append(limits, hourlyLimit(
+			fmt.Sprintf("installation:%d", msg.Installation), cfg.RateLimitInstallation))
+	}
+	if cfg.RateLimitRepo > 0 {
+		limits = append(limits, hourlyLimit("repo:"+msg.Repo, cfg.RateLimitRepo))
+	}
+	if cfg.RateLimitRecipient > 0 {
+		for _, addr := range splitRecipients(msg.Recipients) {
+			limits = append(limits, hourlyLimit(
+				"recipient:"+strings.ToLower(addr), cfg.RateLimitRecipient))
+		}
+	}
+	return limits
+}
+
+// rateLimited checks if msg is over its rate limits. If so, the message is
+// deferred until enough tokens are available. Tokens are only taken for a
+// message's first delivery attempt, so retries don't count against the limits
+// again.
+func (srv Server) rateLimited(msg stats.OutboxMsg) bool {
+	limits := srv.cfg.sendLimits(msg)
+	if len(limits) == 0 || msg.Attempts > 1 {
+		return false
+	}
+	ok, wait, err := srv.db.TakeTokens(limits, time.Now())
+	if err != nil {
+		// don't hold up email because of a database problem
+		slog.Warn("could not check rate limits",
+			slog.String("repo", msg.Repo),
+			slog.String("error", err.Error()))
+		return false
+	}
+	if ok {
+		return false
+	}
+	slog.Info("email deferred by rate limit",
+		slog.String("repo", msg.Repo),
+		slog.Int64("id", msg.Id),
+		slog.String("to", msg.Recipients),
+		slog.Duration("wait", wait))
+	srv.db.AddRateLimited(msg.Repo)
+	if err := srv.db.DeferOutbox(msg.Id, time.Now().Add(wait)); err != nil {
+		slog.Error("could not update outbox", slog.String("error", err.Error()))
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// how long emails to an unconfirmed address are kept waiting for confirmation
+const HELD_RETENTION = 30 * 24 * time.Hour
+
+// how long before an unconfirmed address is asked to confirm again, in case
+// the request was lost
+const CONFIRMATION_RESEND_AFTER = 7 * 24 * time.Hour
+
+// normalizeAddress returns the canonical form of an email address, used to
+// identify recipients.
+func normalizeAddress(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		addr = parsed.Address
+	}
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// BaseURL is the URL the server is reachable at, for links in emails
+func (cfg AppConfig) BaseURL() string {
+	if cfg.Insecure() {
+		return "http://localhost:" + cfg.Port
+	}
+	return "https://" + cfg.Hostname
+}
+
+func (srv Server) confirmURL(addr string) string {
+	q := url.Values{}
+	q.Set("addr", addr)
+	q.Set("token", signToken(srv.signingKey, "confirm", addr))
+	return srv.cfg.BaseURL() + "/confirm?" + q.Encode()
+}
+
+// holdUnconfirmed splits the recipients of an email into those who have
+// confirmed they want email and those who have not (yet). Addresses seen for
+// the first time are sent a confirmation request, on behalf of repo, unless
+// they received commit emails before confirmation was required, which
+// confirms them. Addresses that have not confirmed are asked again every
+// CONFIRMATION_RESEND_AFTER.
+func (srv Server) holdUnconfirmed(installation int64, repo string, to []string) (confirmed []string, held []string) {
+	if !srv.cfg.RequireOptIn {
+		return to, nil
+	}
+	for _, addr := range to {
+		norm := normalizeAddress(addr)
+		ok, known, err := srv.db.RecipientConfirmed(norm)
+		if err == nil && !known {
+			ok, err = srv.confirmPreviousRecipient(norm)
+		}
+		if err != nil {
+			// don't email an address we can't check
+			slog.Error("could not check recipient",
+				slog.String("repo", repo),
+				slog.String("error", err.Error()))
+		}
+		if ok {
+			confirmed = append(confirmed, addr)
+			continue
+		}
+		held = append(held, norm)
+		if err != nil {
+			continue
+		}
+		request := !known
+		if known {
+			request, err = srv.db.RenewConfirmationRequest(norm, time.Now().Add(-CONFIRMATION_RESEND_AFTER))
+			if err != nil {
+				slog.Warn("could not check confirmation request",
+					slog.String("to", norm),
+					slog.String("error", err.Error()))
+			}
+		}
+		if request {
+			if err := srv.requestConfirmation(installation, repo, norm); err != nil {
+				slog.Error("could not request confirmation",
+					slog.String("repo", repo),
+					slog.String("to", norm),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+	return
+}
+
+// confirmPreviousRecipient confirms an address that was sent commit emails
+// before confirmation was required, so that existing recipients keep getting
+// emails when opt-in is turned on.
+func (srv Server) confirmPreviousRecipient(addr string) (bool, error) {
+	emailed, err := srv.db.PreviouslyEmailed(addr)
+	if err != nil || !emailed {
+		return false, err
+	}
+	if err := srv.db.ConfirmRecipient(addr); err != nil {
+		return false, err
+	}
+	slog.Info("recipient confirmed by earlier emails",
+		slog.String("to", addr))
+	return true, nil
+}
+
+var confirmEmailTemplate = template.Must(template.New("confirm").Parse(`<html>
+<body>
+<p>The GitHub repository <b>{{.Repo}}</b> is configured to send commit
+notifications to {{.Addr}}.</p>
+<p><a href="{{.URL}}">Confirm that you want to receive these emails</a>.</p>
+<p>Until you confirm, no commit emails will be sent to this address. If you
+did not expect this email, you can ignore it.</p>
+</body>
+</html>`))
+
+// requestConfirmation records addr as an unconfirmed recipient and queues an
+// email asking it to confirm.
+func (srv Server) requestConfirmation(installation int64, repo string, addr string) error {
+	if err := srv.db.AddRecipient(addr); err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	err := confirmEmailTemplate.Execute(&body, struct {
+		Repo string
+		Addr string
+		URL  string
+	}{repo, addr, srv.confirmURL(addr)})
+	if err != nil {
+		return err
+	}
+	slog.Info("requesting confirmation",
+		slog.String("repo", repo),
+		slog.String("to", addr))
+	return srv.queueEmail(installation, repo, EmailMsg{
+		To:           addr,
+		From:         fmt.Sprintf("commit-email-bot <%s>", srv.cfg.NotifyEmail()),
+		FromAddr:     srv.cfg.EnvelopeSender(),
+		ReplyTo:      srv.cfg.NotifyEmail(),
+		Subject:      fmt.Sprintf("Confirm commit emails for %s", repo),
+		Date:         time.Now().Format(time.RFC1123Z),
+		Body:         body.String(),
+		Confirmation: true,
+	})
+}
+
+var confirmPageTemplate = template.Must(template.New("confirm-page").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Commit Email Bot</title></head>
+<body>
+{{if .Confirmed}}
+<p>Thanks, {{.Addr}} is confirmed and will receive commit emails.</p>
+{{else}}
+<form method="post">
+<input type="hidden" name="addr" value="{{.Addr}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<p>Receive commit emails at {{.Addr}}?</p>
+<button type="submit">Confirm</button>
+</form>
+{{end}}
+</body>
+</html>`))
+
+// confirmHandler confirms a recipient's address from the link in a
+// confirmation email. GET only shows a form, so that link scanners that
+// prefetch URLs do not confirm addresses.
+func (srv Server) confirmHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := req.FormValue("addr")
+	token := req.FormValue("token")
+	if addr == "" || !verifyToken(srv.signingKey, token, "confirm", addr) {
+		http.Error(w, "invalid confirmation link", http.StatusBadRequest)
+		return
+	}
+	page := struct {
+		Addr      string
+		Token     string
+		Confirmed bool
+	}{Addr: addr, Token: token}
+	if req.Method == http.MethodPost {
+		if err := srv.db.ConfirmRecipient(addr); err != nil {
+			http.Error(w, "could not confirm address", http.StatusInternalServerError)
+			return
+		}
+		released, err := srv.db.ReleaseHeld(addr)
+		if err != nil {
+			slog.Error("could not release held emails",
+				slog.String("to", addr),
+				slog.String("error", err.Error()))
+		}
+		slog.Info("recipient confirmed",
+			slog.String("to", addr),
+			slog.Int64("released", released))
+		srv.notifyOutbox()
+		page.Confirmed = true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = confirmPageTemplate.Execute(w, page)
+}
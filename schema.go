@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// where the schema is published
+const SCHEMA_PATH = "/commit-emails.schema.json"
+
+// allowed values of config keys, keyed by their path (with array elements
+// written as [])
+var schemaEnums = map[string][]string{
+	"digest":          {"hourly", "daily", "weekly"},
+	"dedupe":          {"repository", "branch", "none"},
+	"config_source":   {"default-branch", "pushed-ref"},
+	"groups[].format": {"html", "text"},
+	"email.format":    {"html", "text"},
+	"email.style":     {"default", "patch"},
+}
+
+var schemaDescriptions = map[string]string{
+	"version":             fmt.Sprintf("Version of the config format (1 if not set, the latest is %d).", CONFIG_VERSION),
+	"inherit":             "Use the organization's defaults from its .github repository (default true).",
+	"to":                  "Recipients of commit emails.",
+	"cc":                  "Cc recipients of commit emails.",
+	"bcc":                 "Bcc recipients of commit emails.",
+	"groups":              "Additional recipients, each with their own format.",
+	"groups[].name":       "Name of the group, used in error messages.",
+	"groups[].to":         "Recipients in the group.",
+	"groups[].cc":         "Cc recipients in the group.",
+	"groups[].bcc":        "Bcc recipients in the group.",
+	"groups[].format":     "Format of the group's emails (default email.format).",
+	"digest":              "Send a periodic summary instead of one email per commit.",
+	"digest_to":           "Recipients of digests, if different from to, cc, and bcc.",
+	"dedupe":              "When a commit that was already emailed is sent again.",
+	"config_source":       "Where the config for a push is read from.",
+	"notify_codeowners":   "Also email the CODEOWNERS of the files each commit changes.",
+	"codeowners":          "Settings for notify_codeowners.",
+	"codeowners.emails":   "Email addresses of the @users and @org/teams in CODEOWNERS.",
+	"quiet_hours":         "A daily window during which emails are held until it ends.",
+	"quiet_hours.start":   "Start of quiet hours (HH:MM).",
+	"quiet_hours.end":     "End of quiet hours (HH:MM), which can be the next day.",
+	"quiet_hours.tz":      "IANA time zone of start and end (default UTC).",
+	"quiet_hours.summary": "Send one summary per recipient when quiet hours end, instead of the held emails.",
+	"email":               "How commit emails look.",
+	"email.format":        "Format of commit emails.",
+	"email.subject":       "Go template for the subject of commit emails.",
+	"email.header":        "Go template for text shown above the diff.",
+	"email.attach_patch":  "Attach each commit as a .patch file.",
+	"email.style":         "Send commits as git send-email does (patch), instead of the formatted diff (default).",
+}
+
+var addressListType = reflect.TypeOf(AddressList{})
+
+// configSchema returns a JSON Schema for commit-emails.toml, derived from
+// CommitEmailConfig.
+func configSchema() map[string]any {
+	schema := typeSchema(reflect.TypeOf(CommitEmailConfig{}), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = "https://commit-emails.xyz" + SCHEMA_PATH
+	schema["title"] = "commit-emails.toml"
+	return schema
+}
+
+func typeSchema(t reflect.Type, path string) map[string]any {
+	schema := make(map[string]any)
+	if desc, ok := schemaDescriptions[path]; ok {
+		schema["description"] = desc
+	}
+	if t == addressListType {
+		schema["anyOf"] = []any{
+			map[string]any{"type": "string", "description": "a single address"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}
+		return schema
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), path)
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int64:
+		schema["type"] = "integer"
+	case reflect.String:
+		schema["type"] = "string"
+		if enum, ok := schemaEnums[path]; ok {
+			schema["enum"] = enum
+		}
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = typeSchema(t.Elem(), path+"[]")
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = typeSchema(t.Elem(), path+".*")
+	case reflect.Struct:
+		schema["type"] = "object"
+		props := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			// keys without a toml tag match the field name case-insensitively
+			key := field.Tag.Get("toml")
+			if key == "" {
+				key = strings.ToLower(field.Name)
+			}
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			props[key] = typeSchema(field.Type, keyPath)
+		}
+		schema["properties"] = props
+		schema["additionalProperties"] = false
+	}
+	return schema
+}
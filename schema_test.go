@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+// TestSchemaDescriptions checks that every key in the config schema has a
+// description, so that editors can show what it does.
+func TestSchemaDescriptions(t *testing.T) {
+	var check func(schema map[string]any, path string)
+	check = func(schema map[string]any, path string) {
+		if items, ok := schema["items"].(map[string]any); ok {
+			check(items, path+"[]")
+		}
+		if values, ok := schema["additionalProperties"].(map[string]any); ok {
+			check(values, path+".*")
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for key, prop := range props {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			prop := prop.(map[string]any)
+			if _, ok := prop["description"]; !ok {
+				t.Errorf("%s has no description", keyPath)
+			}
+			check(prop, keyPath)
+		}
+	}
+	check(configSchema(), "")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time limit for sending one message (or connecting)
+const SMTP_TIMEOUT = 2 * time.Minute
+
+// idle connections are closed after this long rather than waiting for the
+// server to time them out
+const SMTP_IDLE_TIMEOUT = time.Minute
+
+// maximum number of idle connections kept open to the server
+const SMTP_MAX_IDLE = 4
+
+// smtpMailer sends mail through an SMTP server configured by the
+// AppConfig.Smtp* settings. It keeps a pool of authenticated connections that
+// are reused across batches.
+type smtpMailer struct {
+	host string
+	port string
+	// "tls" (implicit TLS, usually port 465), "starttls", or "none"
+	tlsMode   string
+	tlsConfig *tls.Config
+	// nil if the server does not need authentication
+	auth smtp.Auth
+
+	mu   sync.Mutex
+	idle []*smtpConn
+}
+
+// smtpConn is an authenticated connection to the server
+type smtpConn struct {
+	*smtp.Client
+	// the underlying connection, for setting deadlines
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+func newSMTPMailer(cfg AppConfig) (*smtpMailer, error) {
+	m := &smtpMailer{
+		host:    cfg.SmtpHost,
+		port:    cfg.SmtpPort,
+		tlsMode: cfg.SmtpTLS,
+		tlsConfig: &tls.Config{
+			ServerName:         cfg.SmtpHost,
+			InsecureSkipVerify: cfg.SmtpTLSInsecure,
+		},
+	}
+	switch m.tlsMode {
+	case "tls", "starttls", "none":
+	default:
+		return nil, fmt.Errorf("invalid SMTP TLS mode %s (should be tls, starttls, or none)", m.tlsMode)
+	}
+	if cfg.SmtpCAFile != "" {
+		pem, err := os.ReadFile(cfg.SmtpCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read SMTP CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.SmtpCAFile)
+		}
+		m.tlsConfig.RootCAs = pool
+	}
+	switch cfg.SmtpAuth {
+	case "none":
+	case "plain":
+		m.auth = smtp.PlainAuth("", cfg.SmtpUser, cfg.SmtpPassword, cfg.SmtpHost)
+	case "login":
+		m.auth = &loginAuth{username: cfg.SmtpUser, password: cfg.SmtpPassword, host: cfg.SmtpHost}
+	case "cram-md5":
+		m.auth = smtp.CRAMMD5Auth(cfg.SmtpUser, cfg.SmtpPassword)
+	default:
+		return nil, fmt.Errorf("invalid SMTP auth %s (should be plain, login, cram-md5, or none)", cfg.SmtpAuth)
+	}
+	return m, nil
+}
+
+// dial connects to the server and authenticates
+func (m *smtpMailer) dial() (*smtpConn, error) {
+	addr := net.JoinHostPort(m.host, m.port)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if m.tlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, m.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m.tlsMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(m.tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &smtpConn{Client: c, conn: conn}, nil
+}
+
+// get returns a working connection, reusing an idle one if possible
+func (m *smtpMailer) get() (*smtpConn, error) {
+	for {
+		m.mu.Lock()
+		if len(m.idle) == 0 {
+			m.mu.Unlock()
+			return m.dial()
+		}
+		c := m.idle[len(m.idle)-1]
+		m.idle = m.idle[:len(m.idle)-1]
+		m.mu.Unlock()
+
+		if time.Since(c.lastUsed) < SMTP_IDLE_TIMEOUT {
+			_ = c.conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+			if c.Noop() == nil {
+				return c, nil
+			}
+		}
+		c.Close()
+	}
+}
+
+// put returns a connection to the pool
+func (m *smtpMailer) put(c *smtpConn) {
+	c.lastUsed = time.Now()
+	m.mu.Lock()
+	if len(m.idle) < SMTP_MAX_IDLE {
+		m.idle = append(m.idle, c)
+		c = nil
+	}
+	m.mu.Unlock()
+	if c != nil {
+		_ = c.Quit()
+	}
+}
+
+func (m *smtpMailer) Send(from string, to []string, msg []byte) error {
+	return m.SendBatch([]OutgoingMsg{{From: from, To: to, Msg: msg}})[0]
+}
+
+// SendBatch sends msgs over a single connection. If the server rejects a
+// message the transaction is reset and the connection used for the rest of the
+// batch; if the connection fails, a new one is used.
+func (m *smtpMailer) SendBatch(msgs []OutgoingMsg) []error {
+	errs := make([]error, len(msgs))
+	var c *smtpConn
+	for i, msg := range msgs {
+		if c == nil {
+			var err error
+			c, err = m.get()
+			if err != nil {
+				for j := i; j < len(msgs); j++ {
+					errs[j] = err
+				}
+				return errs
+			}
+		}
+		_ = c.conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+		errs[i] = smtpSend(c.Client, msg.From, msg.To, msg.Msg)
+		if errs[i] == nil {
+			continue
+		}
+		var tpErr *textproto.Error
+		if errors.As(errs[i], &tpErr) && c.Reset() == nil {
+			continue
+		}
+		c.Close()
+		c = nil
+	}
+	if c != nil {
+		m.put(c)
+	}
+	return errs
+}
+
+// smtpSend sends one message over an established connection
+func smtpSend(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which net/smtp does
+// not support.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// like smtp.PlainAuth, refuse to send the password in the clear
+	isLocalhost := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !isLocalhost {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch prompt {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN prompt %q", fromServer)
+}
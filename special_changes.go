@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// images at most this large are shown inline in html emails, up to
+// MAX_INLINE_IMAGES per commit
+const MAX_INLINE_IMAGE_SIZE = 64 * 1024
+const MAX_INLINE_IMAGES = 5
+
+// most commits listed for a submodule update
+const MAX_SUBMODULE_COMMITS = 50
+
+// Git LFS pointer files are smaller than this, and start with
+// LFS_POINTER_VERSION
+const LFS_POINTER_MAX_SIZE = 1024
+const LFS_POINTER_VERSION = "version https://git-lfs.github.com/spec/v1"
+
+// the mode of a submodule (a gitlink) in a tree
+const SUBMODULE_MODE = "160000"
+
+// the object id git uses for a missing side of a change
+const NULL_OID = "0000000000000000000000000000000000000000"
+
+// specialChange is a change to a file that is described rather than shown as a
+// textual diff: a binary file, a Git LFS object, or a submodule.
+type specialChange struct {
+	Path string
+	// Kind is "binary", "lfs", or "submodule"
+	Kind string
+	// Old and New are the blob (or for submodules, commit) ids before and
+	// after, "" if the file was added or deleted
+	Old string
+	New string
+	// sizes of the file (or LFS object) before and after
+	OldSize int64
+	NewSize int64
+	// LFS object ids before and after ("" for a side that is not in LFS)
+	OldOid string
+	NewOid string
+	// Shortlog of a submodule update, if the submodule's repo is synced
+	Shortlog string
+	// Image is the new version of a small image, to show inline
+	Image *Attachment
+}
+
+// specialChanges finds the binary files, Git LFS pointers, and submodules
+// changed by a commit. Merge commits have none, since their diff is only
+// the combined diff of conflicting files.
+func specialChanges(persistPath string, gitDir string, repo string, commitId string) ([]specialChange, error) {
+	raw, err := runGitCmd(gitDir, nil, "diff-tree", "-r", "--root", "--no-commit-id", "--no-abbrev", "-z", commitId)
+	if err != nil {
+		return nil, err
+	}
+	numstat, err := runGitCmd(gitDir, nil, "diff-tree", "-r", "--root", "--no-commit-id", "--numstat", "-z", commitId)
+	if err != nil {
+		return nil, err
+	}
+	// binary files have - for both counts
+	binary := make(map[string]bool)
+	for _, entry := range strings.Split(string(numstat), "\x00") {
+		if path, ok := strings.CutPrefix(entry, "-\t-\t"); ok {
+			binary[path] = true
+		}
+	}
+
+	var changes []specialChange
+	var blobs []string
+	// raw entries are ":<old mode> <new mode> <old id> <new id> <status>",
+	// followed by the path
+	entries := strings.Split(string(raw), "\x00")
+	for i := 0; i+1 < len(entries); i += 2 {
+		fields := strings.Fields(strings.TrimPrefix(entries[i], ":"))
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected diff-tree output %q", entries[i])
+		}
+		change := specialChange{Path: entries[i+1], Kind: "binary", Old: fields[2], New: fields[3]}
+		if change.Old == NULL_OID {
+			change.Old = ""
+		}
+		if change.New == NULL_OID {
+			change.New = ""
+		}
+		if fields[0] == SUBMODULE_MODE || fields[1] == SUBMODULE_MODE {
+			change.Kind = "submodule"
+		}
+		if change.Kind != "submodule" {
+			for _, id := range []string{change.Old, change.New} {
+				if id != "" {
+					blobs = append(blobs, id)
+				}
+			}
+		}
+		if change.Kind == "binary" && !binary[change.Path] {
+			// might be an LFS pointer
+			change.Kind = ""
+		}
+		changes = append(changes, change)
+	}
+
+	sizes, err := gitObjects(gitDir, blobs, false)
+	if err != nil {
+		return nil, err
+	}
+	// read the blobs that could be LFS pointers or inline images
+	var read []string
+	for _, c := range changes {
+		if c.Kind == "" {
+			for _, id := range []string{c.Old, c.New} {
+				if id != "" && sizes[id].Size < LFS_POINTER_MAX_SIZE {
+					read = append(read, id)
+				}
+			}
+		}
+		if c.Kind == "binary" && c.New != "" && sizes[c.New].Size <= MAX_INLINE_IMAGE_SIZE {
+			read = append(read, c.New)
+		}
+	}
+	blobData, err := gitObjects(gitDir, read, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var special []specialChange
+	images := 0
+	for _, c := range changes {
+		c.OldSize, c.NewSize = sizes[c.Old].Size, sizes[c.New].Size
+		switch c.Kind {
+		case "":
+			oldOid, oldSize, oldLFS := parseLFSPointer(blobData[c.Old].Data)
+			newOid, newSize, newLFS := parseLFSPointer(blobData[c.New].Data)
+			if !oldLFS && !newLFS {
+				continue
+			}
+			c.Kind = "lfs"
+			if oldLFS {
+				c.OldOid, c.OldSize = oldOid, oldSize
+			}
+			if newLFS {
+				c.NewOid, c.NewSize = newOid, newSize
+			}
+		case "binary":
+			if data := blobData[c.New].Data; data != nil && images < MAX_INLINE_IMAGES {
+				if image := inlineImage(c.Path, c.New, data); image != nil {
+					c.Image = image
+					images++
+				}
+			}
+		case "submodule":
+			c.Shortlog = submoduleShortlog(persistPath, gitDir, repo, commitId, c)
+		}
+		special = append(special, c)
+	}
+	return special, nil
+}
+
+// parseLFSPointer reads the object id and size from a Git LFS pointer file
+func parseLFSPointer(data []byte) (oid string, size int64, ok bool) {
+	if !bytes.HasPrefix(data, []byte(LFS_POINTER_VERSION+"\n")) {
+		return "", 0, false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			oid = value
+		case "size":
+			size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return oid, size, oid != ""
+}
+
+// inlineImage returns data as an attachment to show inline, if it is an image
+// that email clients can display
+func inlineImage(filePath string, id string, data []byte) *Attachment {
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+	default:
+		return nil
+	}
+	return &Attachment{
+		Name:        path.Base(filePath),
+		ContentType: contentType,
+		Data:        data,
+		ContentID:   id + "@commit-emails",
+	}
+}
+
+// submoduleShortlog summarizes the commits of a submodule update, if the
+// submodule is on GitHub and its repo is synced (because the app is installed
+// on it). Only submodules from the same owner are summarized, so the subjects
+// of another account's commits are not sent to this repo's recipients.
+func submoduleShortlog(persistPath string, gitDir string, repo string, commitId string, c specialChange) string {
+	if c.Old == "" || c.New == "" {
+		return ""
+	}
+	url := submoduleURL(gitDir, commitId, c.Path)
+	subRepo, ok := githubRepoName(repo, url)
+	if !ok {
+		return ""
+	}
+	owner, _, _ := strings.Cut(repo, "/")
+	subOwner, _, _ := strings.Cut(subRepo, "/")
+	if !strings.EqualFold(owner, subOwner) {
+		return ""
+	}
+	subDir := repoGitDir(persistPath, subRepo)
+	if _, err := os.Stat(subDir); err != nil {
+		return ""
+	}
+	commits := c.Old + ".." + c.New
+	out, err := runGitCmd(subDir, nil, "shortlog", fmt.Sprintf("--max-count=%d", MAX_SUBMODULE_COMMITS), commits)
+	if err != nil {
+		// the submodule commits may not have been fetched yet
+		return ""
+	}
+	shortlog := strings.TrimRight(string(out), "\n")
+	if count, err := runGitCmd(subDir, nil, "rev-list", "--count", commits); err == nil {
+		if n, _ := strconv.Atoi(strings.TrimSpace(string(count))); n > MAX_SUBMODULE_COMMITS {
+			shortlog += fmt.Sprintf("\n\n... and %d more commits", n-MAX_SUBMODULE_COMMITS)
+		}
+	}
+	return shortlog
+}
+
+// submoduleURL returns the URL of the submodule at path, from the .gitmodules
+// of commitId
+func submoduleURL(gitDir string, commitId string, subPath string) string {
+	blob := commitId + ":.gitmodules"
+	out, err := runGitCmd(gitDir, nil, "config", "--blob", blob, "-z", "--get-regexp", `^submodule\..*\.path$`)
+	if err != nil {
+		return ""
+	}
+	// entries are "submodule.<name>.path\n<path>"
+	for _, entry := range strings.Split(string(out), "\x00") {
+		key, value, _ := strings.Cut(entry, "\n")
+		if value != subPath {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+		url, err := runGitCmd(gitDir, nil, "config", "--blob", blob, "--get", "submodule."+name+".url")
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(url))
+	}
+	return ""
+}
+
+// githubRepoName returns the full name of a GitHub repo from a submodule URL,
+// which may be relative to the superproject repo.
+func githubRepoName(repo string, url string) (string, bool) {
+	name := ""
+	if strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../") {
+		name = path.Join(repo, url)
+	} else {
+		for _, prefix := range []string{
+			"https://github.com/",
+			"http://github.com/",
+			"git://github.com/",
+			"ssh://git@github.com/",
+			"git@github.com:",
+		} {
+			if rest, ok := strings.CutPrefix(url, prefix); ok {
+				name = rest
+				break
+			}
+		}
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "/"), ".git")
+	owner, repoName, ok := strings.Cut(name, "/")
+	if !ok || owner == "" || repoName == "" || strings.Contains(repoName, "/") || strings.HasPrefix(owner, ".") {
+		return "", false
+	}
+	return name, true
+}
+
+// formatSize formats a file size like "12.3 KiB"
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		value /= 1024
+		if value < 1024 || unit == "GiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return ""
+}
+
+// describe summarizes a change in one line (followed by the shortlog of a
+// submodule update)
+func (c specialChange) describe() string {
+	side := func(id string, size int64, oid string) string {
+		switch c.Kind {
+		case "submodule":
+			return shortId(id)
+		case "lfs":
+			if oid == "" {
+				return formatSize(size) + " (not in LFS)"
+			}
+			algo, hash, _ := strings.Cut(oid, ":")
+			return fmt.Sprintf("%s (%s:%s)", formatSize(size), algo, shortId(hash))
+		}
+		return formatSize(size)
+	}
+	what := map[string]string{
+		"binary":    "binary file",
+		"lfs":       "Git LFS object",
+		"submodule": "submodule",
+	}[c.Kind]
+	var desc string
+	switch {
+	case c.Old == "":
+		desc = fmt.Sprintf("%s: %s added, %s", c.Path, what, side(c.New, c.NewSize, c.NewOid))
+	case c.New == "":
+		desc = fmt.Sprintf("%s: %s deleted, was %s", c.Path, what, side(c.Old, c.OldSize, c.OldOid))
+	default:
+		desc = fmt.Sprintf("%s: %s changed, %s -> %s", c.Path, what,
+			side(c.Old, c.OldSize, c.OldOid), side(c.New, c.NewSize, c.NewOid))
+	}
+	if c.Shortlog != "" {
+		desc += "\n\n  " + strings.ReplaceAll(c.Shortlog, "\n", "\n  ") + "\n"
+	}
+	return desc
+}
+
+func shortId(id string) string {
+	if len(id) > 10 {
+		return id[:10]
+	}
+	return id
+}
+
+// specialPaths are the paths of changes, which are left out of the diff
+func specialPaths(changes []specialChange) []string {
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+const SPECIAL_CHANGES_HEADING = "Changes not shown in the diff:"
+
+// specialChangesText describes changes below a plain text diff
+func specialChangesText(changes []specialChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	text.WriteString("\n" + SPECIAL_CHANGES_HEADING + "\n\n")
+	for _, c := range changes {
+		text.WriteString(c.describe() + "\n")
+	}
+	return text.String()
+}
+
+// specialChangesHtml describes changes below an html diff, showing images
+// from their inline attachments
+func specialChangesHtml(changes []specialChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	var body strings.Builder
+	body.WriteString("<pre>\n<b>" + SPECIAL_CHANGES_HEADING + "</b>\n\n")
+	for _, c := range changes {
+		body.WriteString(html.EscapeString(c.describe()) + "\n")
+		if c.Image != nil {
+			fmt.Fprintf(&body, "<img src=\"cid:%s\" alt=\"%s\" style=\"max-width: 200px; max-height: 200px\">\n",
+				html.EscapeString(c.Image.ContentID), html.EscapeString(c.Path))
+		}
+	}
+	body.WriteString("</pre>")
+	return body.String()
+}
+
+// specialChangesImages are the inline attachments of changes
+func specialChangesImages(changes []specialChange) []Attachment {
+	var images []Attachment
+	for _, c := range changes {
+		if c.Image != nil {
+			images = append(images, *c.Image)
+		}
+	}
+	return images
+}
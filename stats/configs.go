@@ -0,0 +1,53 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// RepoConfig is the last commit-emails.toml seen for a repo.
+type RepoConfig struct {
+	Repo string
+	// Ref is the branch the config was read from, or empty for the default
+	// branch
+	Ref string
+	// git object id of the config file
+	Hash  string
+	Valid bool
+	// Recipients of the last valid config (comma-separated)
+	Recipients string
+}
+
+func createConfigTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists repo_configs (
+		repo text not null,
+		ref text not null default '',
+		hash text not null,
+		valid boolean not null,
+		recipients text not null,
+		updated_at timestamp not null default current_timestamp,
+		primary key (repo, ref)
+		)`)
+	return err
+}
+
+// GetRepoConfig returns the last config recorded for repo and ref, or false if
+// there is none.
+func (db Database) GetRepoConfig(repo string, ref string) (RepoConfig, bool, error) {
+	c := RepoConfig{Repo: repo, Ref: ref}
+	err := db.conn.QueryRow(`select hash, valid, recipients from repo_configs
+where repo = ? and ref = ?`, repo, ref).Scan(&c.Hash, &c.Valid, &c.Recipients)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, false, nil
+	}
+	return c, err == nil, err
+}
+
+// SetRepoConfig records the current config for a repo.
+func (db Database) SetRepoConfig(c RepoConfig) error {
+	_, err := db.conn.Exec(`insert or replace into repo_configs
+	(repo, ref, hash, valid, recipients, updated_at)
+	values (?, ?, ?, ?, ?, current_timestamp)`,
+		c.Repo, c.Ref, c.Hash, c.Valid, c.Recipients)
+	return err
+}
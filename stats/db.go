@@ -14,7 +14,7 @@ type Database struct {
 }
 
 func New(persistPath string) (Database, error) {
-	db, err := sql.Open("sqlite3", filepath.Join(persistPath, "db.sqlite3"))
+	db, err := sql.Open("sqlite3", filepath.Join(persistPath, "db.sqlite3")+"?_busy_timeout=5000")
 	if err != nil {
 		return Database{nil}, err
 	}
@@ -38,6 +38,36 @@ func New(persistPath string) (Database, error) {
 	if err != nil {
 		return Database{nil}, err
 	}
+	if err := createDigestTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createJobTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createSentTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createOutboxTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createRateLimitTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createRecipientTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createSuppressionTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createMailEventTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createConfigTables(db); err != nil {
+		return Database{nil}, err
+	}
+	if err := createQuietTables(db); err != nil {
+		return Database{nil}, err
+	}
 	return Database{conn: db}, err
 }
 
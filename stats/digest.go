@@ -0,0 +1,219 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// DigestCommit is a commit recorded for a later digest email.
+type DigestCommit struct {
+	Id        int64
+	Repo      string
+	Branch    string
+	SHA       string
+	Subject   string
+	Author    string
+	URL       string
+	ShortStat string
+	PushedAt  time.Time
+}
+
+// DigestRepo is a repository with digest emails enabled.
+type DigestRepo struct {
+	Repo string
+	// Installation is the app installation the repo's last push came from
+	Installation int64
+	// Period is one of "hourly", "daily", or "weekly"
+	Period string
+	// Recipients is the To header of digest emails
+	Recipients string
+	// Bcc is a comma-separated list of additional recipients
+	Bcc string
+	// Format of digest emails, "html" (the default) or "text"
+	Format   string
+	LastSent time.Time
+}
+
+func createDigestTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists digest_repos (
+		repo text not null primary key,
+		installation integer not null,
+		period text not null,
+		format text not null,
+		recipients text not null,
+		bcc text not null,
+		last_sent timestamp not null default current_timestamp
+		)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create table if not exists digest_commits (
+		id integer not null primary key autoincrement,
+		repo text not null,
+		branch text not null,
+		sha text not null,
+		subject text not null,
+		author text not null,
+		url text not null,
+		shortstat text not null,
+		pushed_at timestamp not null default current_timestamp,
+		sent boolean not null default false,
+		unique (repo, branch, sha)
+		)`)
+	return err
+}
+
+// AddDigestCommits records commits to be included in the next digest for repo,
+// and updates the repo's digest settings.
+func (db Database) AddDigestCommits(repo string, installation int64, period string, format string, recipients string, bcc string, commits []DigestCommit) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`insert into digest_repos (repo, installation, period, format, recipients, bcc)
+	values (?, ?, ?, ?, ?, ?)
+	on conflict (repo) do update
+	set installation = excluded.installation,
+		period = excluded.period,
+		format = excluded.format,
+		recipients = excluded.recipients,
+		bcc = excluded.bcc`,
+		repo, installation, period, format, recipients, bcc)
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		_, err = tx.Exec(`insert or ignore into digest_commits
+	(repo, branch, sha, subject, author, url, shortstat)
+values (?, ?, ?, ?, ?, ?, ?)`,
+			repo, c.Branch, c.SHA, c.Subject, c.Author, c.URL, c.ShortStat)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DigestRepos returns all repos with digests enabled.
+func (db Database) DigestRepos() ([]DigestRepo, error) {
+	rows, err := db.conn.Query(`select repo, installation, period, format, recipients, bcc, last_sent from digest_repos`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var repos []DigestRepo
+	for rows.Next() {
+		var r DigestRepo
+		if err := rows.Scan(&r.Repo, &r.Installation, &r.Period, &r.Format, &r.Recipients, &r.Bcc, &r.LastSent); err != nil {
+			return nil, err
+		}
+		repos = append(repos, r)
+	}
+	return repos, rows.Err()
+}
+
+// GetDigestRepo returns the digest settings for repo, or false if it does not
+// have digests enabled.
+func (db Database) GetDigestRepo(repo string) (DigestRepo, bool, error) {
+	r := DigestRepo{Repo: repo}
+	err := db.conn.QueryRow(`select installation, period, format, recipients, bcc, last_sent
+from digest_repos where repo = ?`, repo).Scan(&r.Installation, &r.Period, &r.Format, &r.Recipients, &r.Bcc, &r.LastSent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, false, nil
+	}
+	return r, err == nil, err
+}
+
+// PendingDigestCommits returns the commits for repo not yet sent in a digest,
+// oldest first.
+func (db Database) PendingDigestCommits(repo string) ([]DigestCommit, error) {
+	rows, err := db.conn.Query(`select id, repo, branch, sha, subject, author, url, shortstat, pushed_at
+from digest_commits
+where repo = ? and not sent
+order by id`, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var commits []DigestCommit
+	for rows.Next() {
+		var c DigestCommit
+		err := rows.Scan(&c.Id, &c.Repo, &c.Branch, &c.SHA, &c.Subject,
+			&c.Author, &c.URL, &c.ShortStat, &c.PushedAt)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, c)
+	}
+	return commits, rows.Err()
+}
+
+// MarkDigestSent records that a digest for repo was sent at sentAt, covering
+// commits up to and including lastId.
+func (db Database) MarkDigestSent(repo string, lastId int64, sentAt time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := markDigestSent(tx, repo, lastId, sentAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// QueueDigest adds the messages of a digest for repo to the outbox and marks
+// it sent (as in MarkDigestSent) together, so a digest is never queued twice.
+func (db Database) QueueDigest(msgs []OutboxMsg, repo string, lastId int64, sentAt time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addOutbox(tx, msgs); err != nil {
+		return err
+	}
+	if err := markDigestSent(tx, repo, lastId, sentAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func markDigestSent(tx *sql.Tx, repo string, lastId int64, sentAt time.Time) error {
+	_, err := tx.Exec(`update digest_commits set sent = true
+where repo = ? and id <= ?`, repo, lastId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`update digest_repos set last_sent = ? where repo = ?`,
+		sentAt.UTC(), repo)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`delete from digest_commits
+where sent and pushed_at < ?`, sentAt.UTC().Add(-30*24*time.Hour))
+	return err
+}
+
+// DisableDigest removes the digest settings and commits for repo, and adds
+// msgs (a last digest of its pending commits) to the outbox in the same
+// transaction.
+func (db Database) DisableDigest(msgs []OutboxMsg, repo string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addOutbox(tx, msgs); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`delete from digest_repos where repo = ?`, repo); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`delete from digest_commits where repo = ?`, repo); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
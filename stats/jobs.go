@@ -0,0 +1,126 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Job is a webhook delivery waiting to be processed.
+type Job struct {
+	Id         int64
+	DeliveryId string
+	EventType  string
+	Payload    []byte
+	// Status is one of "pending", "running", "done", or "failed"
+	Status   string
+	Attempts int
+	// Force resends emails even if they were already sent
+	Force bool
+}
+
+func createJobTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists jobs (
+		id integer not null primary key autoincrement,
+		delivery_id text not null unique,
+		event_type text not null,
+		payload blob not null,
+		status text not null default 'pending',
+		attempts integer not null default 0,
+		force boolean not null default false,
+		next_attempt timestamp not null default current_timestamp,
+		last_error text not null default '',
+		created_at timestamp not null default current_timestamp,
+		updated_at timestamp not null default current_timestamp
+		)`)
+	return err
+}
+
+// AddJob persists a webhook delivery for processing. A delivery that already
+// failed is queued again from the start, since that is why it would be
+// redelivered. Returns false if the delivery was already queued (or
+// processed).
+func (db Database) AddJob(deliveryId string, eventType string, payload []byte) (bool, error) {
+	res, err := db.conn.Exec(`insert into jobs
+	(delivery_id, event_type, payload) values (?, ?, ?)
+on conflict (delivery_id) do update
+set status = 'pending', attempts = 0, payload = excluded.payload,
+	next_attempt = current_timestamp, updated_at = current_timestamp
+where status = 'failed'`,
+		deliveryId, eventType, payload)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// PruneJobs deletes finished jobs (and their payloads) last updated before
+// finishedBefore.
+func (db Database) PruneJobs(finishedBefore time.Time) error {
+	_, err := db.conn.Exec(`delete from jobs
+where status in ('done', 'failed') and updated_at < ?`, finishedBefore.UTC())
+	return err
+}
+
+// ClaimJob marks the oldest runnable job as running and returns it, or returns
+// nil if no job is ready.
+func (db Database) ClaimJob(now time.Time) (*Job, error) {
+	var job Job
+	err := db.conn.QueryRow(`update jobs
+set status = 'running', attempts = attempts + 1, updated_at = current_timestamp
+where id = (select id from jobs
+	where status = 'pending' and next_attempt <= ?
+	order by next_attempt, id
+	limit 1)
+returning id, delivery_id, event_type, payload, status, attempts, force`, now.UTC()).
+		Scan(&job.Id, &job.DeliveryId, &job.EventType, &job.Payload, &job.Status, &job.Attempts, &job.Force)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FinishJob records the final status of a job ("done" or "failed").
+func (db Database) FinishJob(id int64, status string, jobErr error) error {
+	lastError := ""
+	if jobErr != nil {
+		lastError = jobErr.Error()
+	}
+	_, err := db.conn.Exec(`update jobs
+set status = ?, last_error = ?, updated_at = current_timestamp
+where id = ?`, status, lastError, id)
+	return err
+}
+
+// RetryJob puts a job back in the queue to be attempted again at next.
+func (db Database) RetryJob(id int64, next time.Time, jobErr error) error {
+	_, err := db.conn.Exec(`update jobs
+set status = 'pending', next_attempt = ?, last_error = ?, updated_at = current_timestamp
+where id = ?`, next.UTC(), jobErr.Error(), id)
+	return err
+}
+
+// ResetRunningJobs makes jobs interrupted by a shutdown runnable again.
+func (db Database) ResetRunningJobs() error {
+	_, err := db.conn.Exec(`update jobs set status = 'pending' where status = 'running'`)
+	return err
+}
+
+// ResendJob queues an already processed delivery to be processed again. If
+// force is set, emails are sent even to recipients who already received them.
+// Returns false if there is no such delivery.
+func (db Database) ResendJob(deliveryId string, force bool) (bool, error) {
+	res, err := db.conn.Exec(`update jobs
+set status = 'pending', attempts = 0, force = ?, next_attempt = current_timestamp,
+	updated_at = current_timestamp
+where delivery_id = ? and status != 'running'`, force, deliveryId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
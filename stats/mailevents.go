@@ -0,0 +1,71 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+)
+
+func createMailEventTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists mail_events (
+		id integer not null primary key autoincrement,
+		repo text not null,
+		address text not null,
+		type text not null,
+		detail text not null,
+		created_at timestamp not null default current_timestamp
+		)`)
+	return err
+}
+
+// AddMailEvent records a hard bounce or complaint ("bounce" or "complaint")
+// for an email from repo to address.
+func (db Database) AddMailEvent(repo string, address string, eventType string, detail string) error {
+	_, err := db.conn.Exec(`insert into mail_events
+	(repo, address, type, detail) values (?, ?, ?, ?)`, repo, address, eventType, detail)
+	return err
+}
+
+// OutboxRepoForMessage finds the repo that sent the message with the given
+// Message-ID, if it is still in the outbox.
+func (db Database) OutboxRepoForMessage(messageId string) (string, bool, error) {
+	var repo string
+	err := db.conn.QueryRow(`select repo from outbox where message_id = ?`,
+		messageId).Scan(&repo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return repo, err == nil, err
+}
+
+// OutboxInstallation returns the app installation of the latest message from
+// repo in the outbox, or 0 if there is none.
+func (db Database) OutboxInstallation(repo string) (int64, error) {
+	var installation int64
+	err := db.conn.QueryRow(`select installation from outbox
+where repo = ? and installation != 0
+order by id desc limit 1`, repo).Scan(&installation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return installation, err
+}
+
+// OutboxReposForRecipient returns the repos with messages to recipient in the
+// outbox.
+func (db Database) OutboxReposForRecipient(recipient string) ([]string, error) {
+	rows, err := db.conn.Query(`select distinct repo from outbox
+where recipients = ? and repo != ''`, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var repos []string
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, rows.Err()
+}
@@ -0,0 +1,293 @@
+package stats
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// OutboxMsg is a rendered email waiting to be delivered.
+type OutboxMsg struct {
+	Id           int64
+	Installation int64
+	Repo         string
+	// FromAddr is the envelope sender
+	FromAddr string
+	// Recipients is a comma-separated list of envelope recipients
+	Recipients string
+	Message    []byte
+	// MessageId is the Message-ID header of Message, without angle brackets
+	MessageId string
+	// Status is one of "pending", "sending", "sent", or "dead", or "held" for
+	// messages waiting for the recipient to confirm their address
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+	// Commits the message is about, recorded in sent_emails for its
+	// recipients once it is delivered
+	Commits []OutboxCommit
+}
+
+// OutboxCommit is a commit pushed to a branch that an outbox message is about
+type OutboxCommit struct {
+	Branch string
+	SHA    string
+}
+
+func createOutboxTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists outbox (
+		id integer not null primary key autoincrement,
+		installation integer not null,
+		repo text not null,
+		from_addr text not null,
+		recipients text not null,
+		message blob not null,
+		message_id text not null,
+		status text not null default 'pending',
+		attempts integer not null default 0,
+		next_attempt timestamp not null default current_timestamp,
+		last_error text not null default '',
+		created_at timestamp not null default current_timestamp,
+		updated_at timestamp not null default current_timestamp
+		)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create index if not exists outbox_status
+	on outbox (status, next_attempt)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create table if not exists outbox_commits (
+		outbox_id integer not null,
+		branch text not null,
+		sha text not null,
+		primary key (outbox_id, branch, sha)
+		)`)
+	if err != nil {
+		return err
+	}
+	// for checking if a commit is waiting to be sent
+	_, err = db.Exec(`create index if not exists outbox_commits_sha
+	on outbox_commits (sha)`)
+	return err
+}
+
+// AddOutbox persists messages to be delivered (or held, if their Status is
+// "held"), starting at their NextAttempt if it is set. The messages are added
+// atomically, so they are claimed together if possible.
+func (db Database) AddOutbox(msgs []OutboxMsg) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addOutbox(tx, msgs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func addOutbox(tx *sql.Tx, msgs []OutboxMsg) error {
+	for _, msg := range msgs {
+		status := msg.Status
+		if status == "" {
+			status = "pending"
+		}
+		// messages are due now unless they set NextAttempt
+		var nextAttempt any
+		if !msg.NextAttempt.IsZero() {
+			nextAttempt = msg.NextAttempt.UTC()
+		}
+		res, err := tx.Exec(`insert into outbox
+	(installation, repo, from_addr, recipients, message, message_id, status, next_attempt)
+	values (?, ?, ?, ?, ?, ?, ?, coalesce(?, current_timestamp))`,
+			msg.Installation, msg.Repo, msg.FromAddr, msg.Recipients, msg.Message, msg.MessageId, status,
+			nextAttempt)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, c := range msg.Commits {
+			_, err := tx.Exec(`insert or ignore into outbox_commits (outbox_id, branch, sha)
+	values (?, ?, ?)`, id, c.Branch, c.SHA)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const outboxColumns = `id, installation, repo, from_addr, recipients, message, message_id,
+	status, attempts, next_attempt, last_error, created_at`
+
+func scanOutbox(row interface{ Scan(...any) error }) (OutboxMsg, error) {
+	var msg OutboxMsg
+	err := row.Scan(&msg.Id, &msg.Installation, &msg.Repo, &msg.FromAddr, &msg.Recipients, &msg.Message,
+		&msg.MessageId, &msg.Status, &msg.Attempts, &msg.NextAttempt, &msg.LastError, &msg.CreatedAt)
+	return msg, err
+}
+
+// ClaimOutbox marks up to limit messages due for delivery as sending and
+// returns them, oldest first.
+func (db Database) ClaimOutbox(now time.Time, limit int) ([]OutboxMsg, error) {
+	rows, err := db.conn.Query(`update outbox
+set status = 'sending', attempts = attempts + 1, updated_at = current_timestamp
+where id in (select id from outbox
+	where status = 'pending' and next_attempt <= ?
+	order by next_attempt, id
+	limit ?)
+returning `+outboxColumns, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []OutboxMsg
+	for rows.Next() {
+		msg, err := scanOutbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not guarantee any order
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Id < msgs[j].Id })
+	return msgs, nil
+}
+
+// FinishOutbox records the final status of a message ("sent" or "dead"). A
+// sent message's commits are recorded as sent to its recipients.
+func (db Database) FinishOutbox(id int64, status string, sendErr error) error {
+	lastError := ""
+	if sendErr != nil {
+		lastError = sendErr.Error()
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`update outbox
+set status = ?, last_error = ?, updated_at = current_timestamp
+where id = ?`, status, lastError, id)
+	if err != nil {
+		return err
+	}
+	if status == "sent" {
+		_, err = tx.Exec(`insert or replace into sent_emails (repo, branch, sha, recipient)
+select outbox.repo, outbox_commits.branch, outbox_commits.sha, outbox.recipients
+from outbox_commits join outbox on outbox.id = outbox_commits.outbox_id
+where outbox.id = ?`, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RetryOutbox schedules another delivery attempt for a message at next.
+func (db Database) RetryOutbox(id int64, next time.Time, sendErr error) error {
+	_, err := db.conn.Exec(`update outbox
+set status = 'pending', next_attempt = ?, last_error = ?, updated_at = current_timestamp
+where id = ?`, next.UTC(), sendErr.Error(), id)
+	return err
+}
+
+// DeferOutbox puts a claimed message back to wait until next, without counting
+// it as a delivery attempt.
+func (db Database) DeferOutbox(id int64, next time.Time) error {
+	_, err := db.conn.Exec(`update outbox
+set status = 'pending', attempts = attempts - 1, next_attempt = ?, updated_at = current_timestamp
+where id = ?`, next.UTC(), id)
+	return err
+}
+
+// RequeueOutbox resets a message that is not currently being sent so it is
+// delivered again as soon as possible. Returns false if there is no such
+// message.
+func (db Database) RequeueOutbox(id int64) (bool, error) {
+	res, err := db.conn.Exec(`update outbox
+set status = 'pending', attempts = 0, next_attempt = current_timestamp,
+	updated_at = current_timestamp
+where id = ? and status != 'sending'`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ResetSendingOutbox makes messages interrupted by a shutdown deliverable
+// again.
+func (db Database) ResetSendingOutbox() error {
+	_, err := db.conn.Exec(`update outbox set status = 'pending' where status = 'sending'`)
+	return err
+}
+
+// ListOutbox returns the most recent messages with the given status (or all
+// messages if status is empty).
+func (db Database) ListOutbox(status string, limit int) ([]OutboxMsg, error) {
+	rows, err := db.conn.Query(`select `+outboxColumns+` from outbox
+where ? = '' or status = ?
+order by id desc
+limit ?`, status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []OutboxMsg
+	for rows.Next() {
+		msg, err := scanOutbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// PruneOutbox deletes delivered messages last updated before sentBefore, and
+// held messages created before heldBefore.
+func (db Database) PruneOutbox(sentBefore time.Time, heldBefore time.Time) error {
+	_, err := db.conn.Exec(`delete from outbox
+where (status = 'sent' and updated_at < ?) or (status = 'held' and created_at < ?)`,
+		sentBefore.UTC(), heldBefore.UTC())
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(`delete from outbox_commits
+where outbox_id not in (select id from outbox)`)
+	return err
+}
+
+// ReleaseHeld queues the messages held for recipient for delivery, now or at
+// their NextAttempt if that is later (such as the end of quiet hours).
+func (db Database) ReleaseHeld(recipient string) (int64, error) {
+	res, err := db.conn.Exec(`update outbox
+set status = 'pending', next_attempt = max(next_attempt, current_timestamp),
+	updated_at = current_timestamp
+where status = 'held' and recipients = ?`, recipient)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CancelOutbox deletes undelivered messages from repo to recipient.
+func (db Database) CancelOutbox(repo string, recipient string) (int64, error) {
+	res, err := db.conn.Exec(`delete from outbox
+where repo = ? and recipients = ? and status in ('pending', 'held')`, repo, recipient)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"database/sql"
+	"time"
+)
+
+// QuietCommit is a commit held for a recipient during a repo's quiet hours,
+// to be sent in a summary when they end.
+type QuietCommit struct {
+	DigestCommit
+	Recipient string
+	// Installation is the app installation the commit was pushed from
+	Installation int64
+	// Format of the recipient's emails, "html" or "text"
+	Format string
+	// Since is the start of the quiet hours and ReleaseAt their end
+	Since     time.Time
+	ReleaseAt time.Time
+}
+
+func createQuietTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists quiet_commits (
+		id integer not null primary key autoincrement,
+		repo text not null,
+		recipient text not null,
+		installation integer not null,
+		format text not null,
+		branch text not null,
+		sha text not null,
+		subject text not null,
+		author text not null,
+		url text not null,
+		shortstat text not null,
+		since timestamp not null,
+		release_at timestamp not null,
+		pushed_at timestamp not null default current_timestamp,
+		unique (repo, recipient, branch, sha)
+		)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create index if not exists quiet_commits_release
+	on quiet_commits (release_at)`)
+	return err
+}
+
+// AddQuietCommits holds commits until their ReleaseAt time.
+func (db Database) AddQuietCommits(commits []QuietCommit) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range commits {
+		_, err = tx.Exec(`insert or ignore into quiet_commits
+	(repo, recipient, installation, format, branch, sha, subject, author, url, shortstat, since, release_at)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			c.Repo, c.Recipient, c.Installation, c.Format, c.Branch, c.SHA, c.Subject, c.Author, c.URL, c.ShortStat,
+			c.Since.UTC(), c.ReleaseAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DueQuietCommits returns the held commits released by now, ordered by repo,
+// recipient, and then oldest first.
+func (db Database) DueQuietCommits(now time.Time) ([]QuietCommit, error) {
+	rows, err := db.conn.Query(`select id, repo, recipient, installation, format, branch, sha, subject, author, url, shortstat,
+	since, release_at, pushed_at
+from quiet_commits
+where release_at <= ?
+order by repo, recipient, id`, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var commits []QuietCommit
+	for rows.Next() {
+		var c QuietCommit
+		err := rows.Scan(&c.Id, &c.Repo, &c.Recipient, &c.Installation, &c.Format, &c.Branch, &c.SHA, &c.Subject,
+			&c.Author, &c.URL, &c.ShortStat, &c.Since, &c.ReleaseAt, &c.PushedAt)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, c)
+	}
+	return commits, rows.Err()
+}
+
+// QueueQuietSummary adds the messages of a quiet hours summary to the outbox
+// and removes the held commits it summarizes (ids) together, so a summary is
+// never queued twice.
+func (db Database) QueueQuietSummary(msgs []OutboxMsg, ids []int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addOutbox(tx, msgs); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(`delete from quiet_commits where id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,85 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// RateLimit is a token bucket identified by Key, holding up to Burst tokens and
+// refilled at Rate tokens per second.
+type RateLimit struct {
+	Key   string
+	Burst float64
+	Rate  float64
+}
+
+func createRateLimitTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists rate_buckets (
+		key text not null primary key,
+		tokens real not null,
+		updated_at timestamp not null
+		)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create table if not exists rate_limit_stats (
+		repo text not null primary key,
+		num_deferred integer not null default 0,
+		last_deferred timestamp not null default current_timestamp
+		)`)
+	return err
+}
+
+// AddRateLimited counts an email for repo that was deferred by rate limiting.
+func (db Database) AddRateLimited(repo string) {
+	_, err := db.conn.Exec(`insert into rate_limit_stats (repo, num_deferred) values (?, 1)
+	on conflict (repo) do update
+	set num_deferred = num_deferred + 1,
+		last_deferred = current_timestamp`, repo)
+	if err != nil {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "rate_limit_stats"))
+	}
+}
+
+// TakeTokens takes one token from each of the buckets in limits, or none if any
+// bucket is empty. If the tokens could not be taken, returns how long to wait
+// until they are all available.
+func (db Database) TakeTokens(limits []RateLimit, now time.Time) (ok bool, wait time.Duration, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+	tokens := make([]float64, len(limits))
+	for i, l := range limits {
+		var stored float64
+		var updated time.Time
+		err := tx.QueryRow(`select tokens, updated_at from rate_buckets where key = ?`,
+			l.Key).Scan(&stored, &updated)
+		if errors.Is(err, sql.ErrNoRows) {
+			stored, updated = l.Burst, now
+		} else if err != nil {
+			return false, 0, err
+		}
+		elapsed := now.Sub(updated).Seconds()
+		tokens[i] = math.Min(l.Burst, stored+math.Max(0, elapsed)*l.Rate)
+		if tokens[i] < 1 {
+			w := time.Duration((1 - tokens[i]) / l.Rate * float64(time.Second))
+			wait = max(wait, w)
+		}
+	}
+	if wait > 0 {
+		return false, wait, nil
+	}
+	for i, l := range limits {
+		_, err := tx.Exec(`insert or replace into rate_buckets (key, tokens, updated_at)
+	values (?, ?, ?)`, l.Key, tokens[i]-1, now.UTC())
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	return true, 0, tx.Commit()
+}
@@ -0,0 +1,67 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func createRecipientTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists recipients (
+		address text not null primary key,
+		confirmed boolean not null default false,
+		requested_at timestamp not null default current_timestamp,
+		confirmed_at timestamp
+		)`)
+	return err
+}
+
+// RecipientConfirmed checks if address has confirmed it wants to receive
+// emails. The second result is false if the address has never been seen.
+func (db Database) RecipientConfirmed(address string) (confirmed bool, known bool, err error) {
+	err = db.conn.QueryRow(`select confirmed from recipients where address = ?`,
+		address).Scan(&confirmed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	return confirmed, err == nil, err
+}
+
+// AddRecipient records an address that has been sent a confirmation request.
+func (db Database) AddRecipient(address string) error {
+	_, err := db.conn.Exec(`insert or ignore into recipients (address) values (?)`, address)
+	return err
+}
+
+// ConfirmRecipient marks address as confirmed.
+func (db Database) ConfirmRecipient(address string) error {
+	_, err := db.conn.Exec(`insert into recipients (address, confirmed, confirmed_at)
+	values (?, true, current_timestamp)
+	on conflict (address) do update
+	set confirmed = true, confirmed_at = current_timestamp
+	where not confirmed`, address)
+	return err
+}
+
+// RenewConfirmationRequest records that an unconfirmed address is being sent
+// another confirmation request, if its last request was before requestedBefore.
+// Returns false if the address has confirmed or was asked more recently.
+func (db Database) RenewConfirmationRequest(address string, requestedBefore time.Time) (bool, error) {
+	res, err := db.conn.Exec(`update recipients set requested_at = current_timestamp
+where address = ? and not confirmed and requested_at < ?`, address, requestedBefore.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// PreviouslyEmailed checks if any commit email was sent to address (a
+// normalized address), which means it received emails before confirmation was
+// required.
+func (db Database) PreviouslyEmailed(address string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`select count(*) from sent_emails where recipient = ? limit 1`,
+		address).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,41 @@
+package stats
+
+import (
+	"database/sql"
+)
+
+func createSentTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists sent_emails (
+		repo text not null,
+		branch text not null,
+		sha text not null,
+		recipient text not null,
+		sent_at timestamp not null default current_timestamp,
+		primary key (repo, branch, sha, recipient)
+		)`)
+	if err != nil {
+		return err
+	}
+	// for checking if a commit was sent on any branch
+	_, err = db.Exec(`create index if not exists sent_emails_sha
+	on sent_emails (repo, sha, recipient)`)
+	return err
+}
+
+// WasSent checks if an email for commit sha in repo was already sent to
+// recipient (a normalized address), on the given branch or on any branch if
+// branch is empty. Emails waiting in the outbox, and commits held for a quiet
+// hours summary, count as sent.
+func (db Database) WasSent(repo string, branch string, sha string, recipient string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`select
+	(select count(*) from sent_emails
+	where repo = ?1 and (?2 = '' or branch = ?2) and sha = ?3 and recipient = ?4) +
+	(select count(*) from outbox_commits join outbox on outbox.id = outbox_commits.outbox_id
+	where outbox.repo = ?1 and (?2 = '' or outbox_commits.branch = ?2) and outbox_commits.sha = ?3
+		and outbox.recipients = ?4 and outbox.status in ('pending', 'sending', 'held')) +
+	(select count(*) from quiet_commits
+	where repo = ?1 and (?2 = '' or branch = ?2) and sha = ?3 and recipient = ?4)`,
+		repo, branch, sha, recipient).Scan(&n)
+	return n > 0, err
+}
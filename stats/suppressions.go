@@ -0,0 +1,37 @@
+package stats
+
+import (
+	"database/sql"
+)
+
+func createSuppressionTables(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists suppressions (
+		repo text not null,
+		address text not null,
+		reason text not null,
+		created_at timestamp not null default current_timestamp,
+		primary key (repo, address)
+		)`)
+	return err
+}
+
+// AddSuppression stops emails from repo to address. Reason records why (for
+// example, "unsubscribe" or "bounce"). Returns false if the address was already
+// suppressed.
+func (db Database) AddSuppression(repo string, address string, reason string) (bool, error) {
+	res, err := db.conn.Exec(`insert or ignore into suppressions
+	(repo, address, reason) values (?, ?, ?)`, repo, address, reason)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsSuppressed checks if emails from repo to address have been stopped.
+func (db Database) IsSuppressed(repo string, address string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`select count(*) from suppressions
+where repo = ? and address = ?`, repo, address).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadSigningKey reads the secret used to sign links in emails from
+// signing.key in the persist path, creating it if needed.
+func loadSigningKey(persistPath string) ([]byte, error) {
+	path := filepath.Join(persistPath, "signing.key")
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) >= 32 {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, fmt.Errorf("could not save signing key: %w", err)
+	}
+	return key, nil
+}
+
+// signToken computes an HMAC over parts, for links that should only work if
+// they came from one of our emails
+func signToken(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyToken(key []byte, token string, parts ...string) bool {
+	return hmac.Equal([]byte(token), []byte(signToken(key, parts...)))
+}
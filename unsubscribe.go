@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (srv Server) unsubscribeURL(repo string, addr string) string {
+	q := url.Values{}
+	q.Set("repo", repo)
+	q.Set("addr", addr)
+	q.Set("token", signToken(srv.signingKey, "unsubscribe", repo, addr))
+	return srv.cfg.BaseURL() + "/unsubscribe?" + q.Encode()
+}
+
+// withUnsubscribe personalizes email for one recipient, adding
+// List-Unsubscribe headers (RFC 8058) and a footer link for unsubscribing from
+// repo. Patches only get the header, since git format-patch already ends them
+// with a signature.
+func (srv Server) withUnsubscribe(email EmailMsg, repo string, addr string) EmailMsg {
+	link := srv.unsubscribeURL(repo, addr)
+	email.ListUnsubscribe = link
+	if email.Patch {
+		return email
+	}
+	if email.Format == "text" {
+		email.Body += fmt.Sprintf("\n-- \nUnsubscribe from commit emails for %s: %s\n", repo, link)
+		return email
+	}
+	footer := fmt.Sprintf(`<p style="font-size: small"><a href="%s">Unsubscribe</a> from commit emails for %s</p>`,
+		html.EscapeString(link), html.EscapeString(repo))
+	if i := strings.LastIndex(email.Body, "</body>"); i >= 0 {
+		email.Body = email.Body[:i] + footer + "\n" + email.Body[i:]
+	} else {
+		email.Body += "\n" + footer
+	}
+	return email
+}
+
+// unsuppressedRecipients filters to to the addresses that have not
+// unsubscribed from repo.
+func (srv Server) unsuppressedRecipients(repo string, to []string) []string {
+	var filtered []string
+	for _, addr := range to {
+		suppressed, err := srv.db.IsSuppressed(repo, normalizeAddress(addr))
+		if err != nil {
+			slog.Warn("could not check suppressions",
+				slog.String("repo", repo),
+				slog.String("error", err.Error()))
+		}
+		if suppressed {
+			continue
+		}
+		filtered = append(filtered, addr)
+	}
+	return filtered
+}
+
+var unsubscribePageTemplate = template.Must(template.New("unsubscribe-page").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Commit Email Bot</title></head>
+<body>
+{{if .Done}}
+<p>{{.Addr}} will no longer receive commit emails for {{.Repo}}.</p>
+{{else}}
+<form method="post">
+<p>Stop sending commit emails for {{.Repo}} to {{.Addr}}?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}
+</body>
+</html>`))
+
+// unsubscribeHandler handles unsubscribe links. A POST unsubscribes
+// immediately, which is also how mail clients implement one-click unsubscribe
+// (RFC 8058); a GET from the footer link shows a form to do so.
+func (srv Server) unsubscribeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	repo, addr := q.Get("repo"), q.Get("addr")
+	if repo == "" || addr == "" || !verifyToken(srv.signingKey, q.Get("token"), "unsubscribe", repo, addr) {
+		http.Error(w, "invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	page := struct {
+		Repo string
+		Addr string
+		Done bool
+	}{Repo: repo, Addr: addr}
+	if req.Method == http.MethodPost {
+		if _, err := srv.db.AddSuppression(repo, addr, "unsubscribe"); err != nil {
+			http.Error(w, "could not unsubscribe", http.StatusInternalServerError)
+			return
+		}
+		cancelled, err := srv.db.CancelOutbox(repo, addr)
+		if err != nil {
+			slog.Warn("could not cancel queued emails",
+				slog.String("repo", repo),
+				slog.String("error", err.Error()))
+		}
+		slog.Info("unsubscribed",
+			slog.String("repo", repo),
+			slog.String("to", addr),
+			slog.Int64("cancelled", cancelled))
+		page.Done = true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = unsubscribePageTemplate.Execute(w, page)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// largest config accepted by /validate
+const MAX_VALIDATE_SIZE = 64 * 1024
+
+// ConfigProblem is an error or warning found when validating a config.
+type ConfigProblem struct {
+	// File is the file with the problem (commit-emails.toml or CODEOWNERS)
+	File    string `json:"file"`
+	Message string `json:"message"`
+	// Key is the config key the problem is about, if any
+	Key    string `json:"key,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+func (p ConfigProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// ConfigReport is the result of validating a config. The config is valid if
+// it has no errors; warnings do not stop emails from being sent.
+type ConfigReport struct {
+	Valid    bool            `json:"valid"`
+	Errors   []ConfigProblem `json:"errors"`
+	Warnings []ConfigProblem `json:"warnings"`
+}
+
+// checkConfig validates a commit-emails.toml and, optionally, the CODEOWNERS
+// file used with notify_codeowners.
+func checkConfig(configText []byte, codeownersText []byte) ConfigReport {
+	report := ConfigReport{Errors: []ConfigProblem{}, Warnings: []ConfigProblem{}}
+	var config CommitEmailConfig
+	unknown, deprecations, err := decodeConfig(configText, CONFIG_PATH, &config)
+	if err == nil {
+		for _, msg := range deprecations {
+			report.Warnings = append(report.Warnings, ConfigProblem{File: CONFIG_PATH, Message: msg})
+		}
+		for _, key := range unknown {
+			report.Warnings = append(report.Warnings, ConfigProblem{
+				File:    CONFIG_PATH,
+				Message: fmt.Sprintf("unknown key %s", key),
+				Key:     key,
+			})
+		}
+		_, err = validateConfig(config, unknown)
+	}
+	var cfgErr ConfigError
+	if errors.As(err, &cfgErr) {
+		file := cfgErr.File
+		if file == "" {
+			file = CONFIG_PATH
+		}
+		messages := cfgErr.Problems
+		if len(messages) == 0 {
+			messages = []string{cfgErr.Message}
+		}
+		for _, msg := range messages {
+			report.Errors = append(report.Errors, ConfigProblem{
+				File:    file,
+				Message: msg,
+				Line:    cfgErr.Line,
+				Column:  cfgErr.Column,
+			})
+		}
+	} else if err != nil {
+		report.Errors = append(report.Errors, ConfigProblem{File: CONFIG_PATH, Message: err.Error()})
+	}
+	if codeownersText != nil {
+		report.Warnings = append(report.Warnings, codeownersProblems(string(codeownersText), config.Codeowners)...)
+	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// codeownersProblems finds the lines of a CODEOWNERS file that are ignored
+// and the owners that will not be emailed.
+func codeownersProblems(text string, owners CodeownersConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	unmapped := make(map[string]bool)
+	for i, line := range strings.Split(text, "\n") {
+		fields := codeownersFields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		problem := ConfigProblem{File: "CODEOWNERS", Line: i + 1, Column: 1}
+		if _, err := codeownersPattern(fields[0]); err != nil {
+			problem.Message = fmt.Sprintf("invalid pattern %s (the line is ignored): %s", fields[0], err)
+			problems = append(problems, problem)
+			continue
+		}
+		for _, owner := range fields[1:] {
+			if unmapped[owner] {
+				continue
+			}
+			if len(owners.ownerAddresses(owner)) == 0 {
+				unmapped[owner] = true
+				if strings.HasPrefix(owner, "@") {
+					problem.Message = fmt.Sprintf("%s has no address in codeowners.emails", owner)
+				} else {
+					problem.Message = fmt.Sprintf("invalid owner %s", owner)
+				}
+				problems = append(problems, problem)
+			}
+		}
+	}
+	return problems
+}
+
+// validateHandler validates a config posted as the request body, either as
+// TOML or as JSON of the form {"config": "...", "codeowners": "..."}, and
+// responds with a ConfigReport.
+func (srv Server) validateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MAX_VALIDATE_SIZE))
+	if err != nil {
+		http.Error(w, "config is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	configText := body
+	var codeownersText []byte
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		var input struct {
+			Config     string  `json:"config"`
+			Codeowners *string `json:"codeowners"`
+		}
+		if err := json.Unmarshal(body, &input); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		configText = []byte(input.Config)
+		if input.Codeowners != nil {
+			codeownersText = []byte(*input.Codeowners)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(checkConfig(configText, codeownersText))
+}
+
+// schemaHandler serves the JSON Schema for commit-emails.toml
+func (srv Server) schemaHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Cache-Control", "max-age=600")
+	_ = json.NewEncoder(w).Encode(configSchema())
+}